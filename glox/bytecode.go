@@ -0,0 +1,601 @@
+package glox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// A .loxc file is a fixed header followed by the serialized top-level
+// function:
+//
+//	magic    "\x7fLOXC"
+//	version  uint16, big-endian
+//	checksum uint32, big-endian CRC-32 (IEEE) of everything after the header
+//
+// A function is its name (a presence byte, then a string), arity,
+// upvalue count and chunk. A chunk is its code, its line runs with offsets
+// delta-encoded, and its constant pool, each constant prefixed by a tag.
+// Integers are unsigned varints, strings a varint length followed by the
+// bytes, and numbers the eight little-endian bytes of the float64.
+//
+// The magic starts with a byte that can't begin a Lox script, so RunFile
+// never mistakes source for bytecode.
+const (
+	BYTECODE_MAGIC       = "\x7fLOXC"
+	BYTECODE_VERSION     = 1
+	BYTECODE_HEADER_SIZE = len(BYTECODE_MAGIC) + 2 + 4
+)
+
+const (
+	CONSTANT_NUMBER byte = iota
+	CONSTANT_STRING
+	CONSTANT_FUNCTION
+)
+
+// ErrInvalidBytecode is wrapped by every error loading a .loxc file that is
+// corrupt, truncated or from another version.
+var ErrInvalidBytecode = errors.New("invalid bytecode")
+
+// Compile compiles source and serializes the result, to be run later with
+// InterpretBytecode. A script that doesn't compile returns a *CompileError.
+func (vm *VM) Compile(source string, name string) ([]byte, error) {
+	function, diagnostics := vm.compile(source)
+	if function == nil {
+		return nil, &CompileError{
+			Script:      name,
+			Source:      source,
+			Diagnostics: diagnostics,
+		}
+	}
+
+	return encodeBytecode(function), nil
+}
+
+// encodeBytecode serializes function behind a header for the current
+// version.
+func encodeBytecode(function *ObjFunction) []byte {
+	var payload bytes.Buffer
+	writeFunction(&payload, function)
+
+	var out bytes.Buffer
+	out.WriteString(BYTECODE_MAGIC)
+	binary.Write(&out, binary.BigEndian, uint16(BYTECODE_VERSION))
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	out.Write(payload.Bytes())
+	return out.Bytes()
+}
+
+func isBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BYTECODE_MAGIC))
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+}
+
+func writeString(buf *bytes.Buffer, str string) {
+	writeUvarint(buf, uint64(len(str)))
+	buf.WriteString(str)
+}
+
+func writeFunction(buf *bytes.Buffer, function *ObjFunction) {
+	if function.name == nil {
+		buf.WriteByte(0)
+	} else {
+		buf.WriteByte(1)
+		writeString(buf, function.name.str)
+	}
+	writeUvarint(buf, uint64(function.arity))
+	writeUvarint(buf, uint64(function.upvalueCount))
+	writeChunk(buf, &function.chunk)
+}
+
+func writeChunk(buf *bytes.Buffer, chunk *Chunk) {
+	writeUvarint(buf, uint64(chunk.count))
+	buf.Write(chunk.code)
+
+	writeUvarint(buf, uint64(len(chunk.lines)))
+	previous := 0
+	for _, run := range chunk.lines {
+		writeUvarint(buf, uint64(run.offset-previous))
+		writeUvarint(buf, uint64(run.line))
+		writeUvarint(buf, uint64(run.column))
+		previous = run.offset
+	}
+
+	writeUvarint(buf, uint64(chunk.constants.count))
+	for _, constant := range chunk.constants.values {
+		switch {
+		case constant.isType(VAL_NUMBER):
+			buf.WriteByte(CONSTANT_NUMBER)
+			var bits [8]byte
+			binary.LittleEndian.PutUint64(bits[:], math.Float64bits(constant.asNumber()))
+			buf.Write(bits[:])
+		case constant.isString():
+			buf.WriteByte(CONSTANT_STRING)
+			writeString(buf, constant.asString().str)
+		case constant.isFunction():
+			buf.WriteByte(CONSTANT_FUNCTION)
+			writeFunction(buf, constant.asFunction())
+		default:
+			// The compiler only ever adds the constants above.
+			panic(fmt.Sprintf("cannot serialize constant %v", constant))
+		}
+	}
+}
+
+// bytecodeReader decodes a payload, remembering the first error so callers
+// can check once at the end instead of after every read.
+type bytecodeReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bytecodeReader) fail(format string, a ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: %s", ErrInvalidBytecode, fmt.Sprintf(format, a...))
+	}
+}
+
+func (r *bytecodeReader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos >= len(r.data) {
+		r.fail("unexpected end of data")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *bytecodeReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data)-r.pos {
+		r.fail("unexpected end of data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *bytecodeReader) readInt() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 || n > math.MaxInt32 {
+		r.fail("bad integer at offset %d", r.pos)
+		return 0
+	}
+	r.pos += size
+	return int(n)
+}
+
+func (r *bytecodeReader) readString() string {
+	return string(r.readBytes(r.readInt()))
+}
+
+// loadBytecode checks the header of data and rebuilds the function it holds.
+// A matching checksum only rules out accidental damage, so the code is then
+// verified before anything runs it.
+func (vm *VM) loadBytecode(data []byte) (*ObjFunction, error) {
+	if len(data) < BYTECODE_HEADER_SIZE || !isBytecode(data) {
+		return nil, fmt.Errorf("%w: not a glox bytecode file", ErrInvalidBytecode)
+	}
+	version := binary.BigEndian.Uint16(data[len(BYTECODE_MAGIC):])
+	if version != BYTECODE_VERSION {
+		return nil, fmt.Errorf("%w: version %d, expected %d", ErrInvalidBytecode, version, BYTECODE_VERSION)
+	}
+	checksum := binary.BigEndian.Uint32(data[len(BYTECODE_MAGIC)+2:])
+	payload := data[BYTECODE_HEADER_SIZE:]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidBytecode)
+	}
+
+	r := &bytecodeReader{data: payload}
+	// Keep the functions being loaded on the stack so a collection
+	// triggered by the objects allocated for them can't reclaim them.
+	base := vm.stackTop
+	function := vm.readFunction(r)
+	vm.stackTop = base
+	if r.err == nil && r.pos != len(payload) {
+		r.fail("%d unexpected trailing bytes", len(payload)-r.pos)
+	}
+	if r.err == nil && function.upvalueCount != 0 {
+		// There is no enclosing closure for the script to capture from.
+		r.fail("script has %d upvalues", function.upvalueCount)
+	}
+	if r.err == nil && function.arity != 0 {
+		r.fail("script takes %d arguments", function.arity)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := verifyFunction(function); err != nil {
+		return nil, err
+	}
+	return function, nil
+}
+
+func (vm *VM) readFunction(r *bytecodeReader) *ObjFunction {
+	function := vm.newFunction()
+	vm.push(OBJ_VAL(function))
+	defer vm.pop()
+
+	switch r.readByte() {
+	case 0:
+	case 1:
+		function.name = vm.allocateString(r.readString())
+	default:
+		r.fail("bad function name flag")
+	}
+	function.arity = r.readInt()
+	function.upvalueCount = r.readInt()
+	vm.readChunk(r, &function.chunk)
+	return function
+}
+
+func (vm *VM) readChunk(r *bytecodeReader, chunk *Chunk) {
+	count := r.readInt()
+	chunk.code = append([]byte(nil), r.readBytes(count)...)
+	chunk.count = len(chunk.code)
+	chunk.capacity = cap(chunk.code)
+
+	runs := r.readInt()
+	offset := 0
+	for i := 0; i < runs && r.err == nil; i++ {
+		offset += r.readInt()
+		position := Position{line: r.readInt(), column: r.readInt()}
+		chunk.lines = append(chunk.lines, LineRun{offset, position})
+	}
+
+	constants := r.readInt()
+	for i := 0; i < constants && r.err == nil; i++ {
+		switch tag := r.readByte(); tag {
+		case CONSTANT_NUMBER:
+			bits := r.readBytes(8)
+			if bits != nil {
+				chunk.constants.write(NUMBER_VAL(math.Float64frombits(binary.LittleEndian.Uint64(bits))))
+			}
+		case CONSTANT_STRING:
+			chunk.constants.write(OBJ_VAL(vm.allocateString(r.readString())))
+		case CONSTANT_FUNCTION:
+			chunk.constants.write(OBJ_VAL(vm.readFunction(r)))
+		default:
+			r.fail("unknown constant tag %d", tag)
+		}
+	}
+}
+
+// verifyFunction checks the code of function, and of every function in its
+// constant pool, before the dispatch loop runs it. Every opcode must be
+// known with all its operands present; constant, upvalue and jump operands
+// must stay inside the pool, the upvalues and the code; and along every path
+// through the code the stack must hold enough values for each instruction,
+// agree in depth wherever paths meet, cover every local slot used, and end
+// in OP_RETURN. The types of the values on the stack aren't known until run
+// time, so the instructions that rely on them check for themselves.
+func verifyFunction(function *ObjFunction) error {
+	for _, constant := range function.chunk.constants.values {
+		if constant.isFunction() {
+			if err := verifyFunction(constant.asFunction()); err != nil {
+				return err
+			}
+		}
+	}
+
+	v := &bytecodeVerifier{function: function, chunk: &function.chunk}
+	v.decode()
+	v.checkStack()
+	return v.err
+}
+
+// decodedInstruction is one instruction along with its effect on the stack:
+// it needs pops values there, replaces them with pushes values and uses
+// local slot, if that isn't -1. target is where a jump goes, or -1.
+type decodedInstruction struct {
+	offset int
+	next   int
+	op     OpCode
+	target int
+	pops   int
+	pushes int
+	slot   int
+}
+
+// bytecodeVerifier walks the instructions of one chunk, remembering the
+// first problem found like bytecodeReader does.
+type bytecodeVerifier struct {
+	function *ObjFunction
+	chunk    *Chunk
+	// offset is the instruction being checked and next the first byte of
+	// it not yet read.
+	offset int
+	next   int
+	err    error
+
+	instructions []decodedInstruction
+	// index maps the offset of each instruction to its place in
+	// instructions, and every other offset to -1.
+	index []int
+}
+
+func (v *bytecodeVerifier) fail(format string, a ...interface{}) {
+	if v.err != nil {
+		return
+	}
+	name := "script"
+	if v.function.name != nil {
+		name = v.function.name.str
+	}
+	v.err = fmt.Errorf("%w: %s at offset %d of %s",
+		ErrInvalidBytecode, fmt.Sprintf(format, a...), v.offset, name)
+}
+
+// read returns the next size bytes of code as a big-endian operand.
+func (v *bytecodeVerifier) read(size int) int {
+	if v.err != nil {
+		return 0
+	}
+	if size > v.chunk.count-v.next {
+		v.fail("truncated operand")
+		return 0
+	}
+	operand := 0
+	for i := 0; i < size; i++ {
+		operand = operand<<8 | int(v.chunk.code[v.next])
+		v.next++
+	}
+	return operand
+}
+
+func (v *bytecodeVerifier) readConstant(size int) Value {
+	index := v.read(size)
+	if v.err != nil {
+		return NIL_VAL()
+	}
+	if index >= v.chunk.constants.count {
+		v.fail("constant %d out of range", index)
+		return NIL_VAL()
+	}
+	return v.chunk.constants.values[index]
+}
+
+func (v *bytecodeVerifier) readName(size int) {
+	if constant := v.readConstant(size); v.err == nil && !constant.isString() {
+		v.fail("name operand %v is not a string", constant)
+	}
+}
+
+func (v *bytecodeVerifier) readUpvalue() {
+	if slot := v.read(1); v.err == nil && slot >= v.function.upvalueCount {
+		v.fail("upvalue %d out of range", slot)
+	}
+}
+
+// readClosure checks the constant of OP_CLOSURE and the upvalue entries
+// that follow it, returning the highest local slot captured or -1.
+func (v *bytecodeVerifier) readClosure(size int) int {
+	constant := v.readConstant(size)
+	if v.err != nil {
+		return -1
+	}
+	if !constant.isFunction() {
+		v.fail("closure operand %v is not a function", constant)
+		return -1
+	}
+	function := constant.asFunction()
+	slot := -1
+	for i := 0; i < function.upvalueCount && v.err == nil; i++ {
+		flags := byte(v.read(1))
+		indexSize := 1
+		if flags&UPVALUE_LONG != 0 {
+			indexSize = 3
+		}
+		index := v.read(indexSize)
+		if v.err != nil {
+			break
+		}
+		if flags&UPVALUE_LOCAL != 0 {
+			if index > slot {
+				slot = index
+			}
+		} else if index >= v.function.upvalueCount {
+			v.fail("captured upvalue %d out of range", index)
+		}
+	}
+	return slot
+}
+
+// decode splits the code into instructions, checking their operands.
+func (v *bytecodeVerifier) decode() {
+	if v.function.upvalueCount > math.MaxUint8+1 {
+		v.fail("%d upvalues", v.function.upvalueCount)
+		return
+	}
+
+	v.index = make([]int, v.chunk.count)
+	for i := range v.index {
+		v.index[i] = -1
+	}
+	for v.next < v.chunk.count && v.err == nil {
+		v.offset = v.next
+		v.index[v.offset] = len(v.instructions)
+		in := decodedInstruction{offset: v.offset, op: OpCode(v.chunk.code[v.offset]), target: -1, slot: -1}
+		v.next++
+
+		switch in.op {
+		case OP_NIL, OP_TRUE, OP_FALSE:
+			in.pushes = 1
+		case OP_POP, OP_PRINT, OP_CLOSE_UPVALUE, OP_RETURN:
+			in.pops = 1
+		case OP_NOT, OP_NEGATE:
+			in.pops, in.pushes = 1, 1
+		case OP_EQUAL, OP_GREATER, OP_LESS, OP_ADD, OP_SUBSTRACT, OP_MULTIPLY, OP_DIVIDE, OP_INHERIT:
+			in.pops, in.pushes = 2, 1
+		case OP_GET_LOCAL:
+			in.slot, in.pushes = v.read(1), 1
+		case OP_GET_LOCAL_LONG:
+			in.slot, in.pushes = v.read(3), 1
+		case OP_SET_LOCAL:
+			in.slot, in.pops, in.pushes = v.read(1), 1, 1
+		case OP_SET_LOCAL_LONG:
+			in.slot, in.pops, in.pushes = v.read(3), 1, 1
+		case OP_GET_UPVALUE:
+			v.readUpvalue()
+			in.pushes = 1
+		case OP_SET_UPVALUE:
+			v.readUpvalue()
+			in.pops, in.pushes = 1, 1
+		case OP_CONSTANT:
+			v.readConstant(1)
+			in.pushes = 1
+		case OP_CONSTANT_LONG:
+			v.readConstant(3)
+			in.pushes = 1
+		case OP_GET_GLOBAL, OP_CLASS:
+			v.readName(1)
+			in.pushes = 1
+		case OP_GET_GLOBAL_LONG, OP_CLASS_LONG:
+			v.readName(3)
+			in.pushes = 1
+		case OP_DEFINE_GLOBAL:
+			v.readName(1)
+			in.pops = 1
+		case OP_DEFINE_GLOBAL_LONG:
+			v.readName(3)
+			in.pops = 1
+		case OP_SET_GLOBAL, OP_GET_PROPERTY:
+			v.readName(1)
+			in.pops, in.pushes = 1, 1
+		case OP_SET_GLOBAL_LONG, OP_GET_PROPERTY_LONG:
+			v.readName(3)
+			in.pops, in.pushes = 1, 1
+		case OP_SET_PROPERTY, OP_GET_SUPER, OP_METHOD:
+			v.readName(1)
+			in.pops, in.pushes = 2, 1
+		case OP_SET_PROPERTY_LONG, OP_GET_SUPER_LONG, OP_METHOD_LONG:
+			v.readName(3)
+			in.pops, in.pushes = 2, 1
+		case OP_CALL:
+			in.pops, in.pushes = v.read(1)+1, 1
+		case OP_INVOKE:
+			v.readName(1)
+			in.pops, in.pushes = v.read(1)+1, 1
+		case OP_INVOKE_LONG:
+			v.readName(3)
+			in.pops, in.pushes = v.read(1)+1, 1
+		case OP_SUPER_INVOKE:
+			// The superclass sits above the receiver and arguments.
+			v.readName(1)
+			in.pops, in.pushes = v.read(1)+2, 1
+		case OP_SUPER_INVOKE_LONG:
+			v.readName(3)
+			in.pops, in.pushes = v.read(1)+2, 1
+		case OP_JUMP:
+			jump := v.read(2)
+			in.target = v.next + jump
+		case OP_JUMP_IF_FALSE:
+			// The condition is only peeked at.
+			jump := v.read(2)
+			in.target = v.next + jump
+			in.pops, in.pushes = 1, 1
+		case OP_LOOP:
+			jump := v.read(2)
+			in.target = v.next - jump
+		case OP_CLOSURE:
+			in.slot, in.pushes = v.readClosure(1), 1
+		case OP_CLOSURE_LONG:
+			in.slot, in.pushes = v.readClosure(3), 1
+		default:
+			v.fail("unknown opcode %d", in.op)
+		}
+		in.next = v.next
+		v.instructions = append(v.instructions, in)
+	}
+	if v.err != nil {
+		return
+	}
+
+	for _, in := range v.instructions {
+		if in.target != -1 && (in.target < 0 || in.target >= v.chunk.count || v.index[in.target] == -1) {
+			v.offset = in.offset
+			v.fail("jump to %d is not an instruction", in.target)
+			return
+		}
+	}
+}
+
+// checkStack follows every path through the code from its entry, where the
+// stack holds the callee and its arguments, tracking how deep the stack is
+// before each instruction.
+func (v *bytecodeVerifier) checkStack() {
+	if v.err != nil {
+		return
+	}
+	if len(v.instructions) == 0 {
+		v.fail("empty code")
+		return
+	}
+
+	depths := make([]int, len(v.instructions))
+	for i := range depths {
+		depths[i] = -1
+	}
+	depths[0] = v.function.arity + 1
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		in := v.instructions[i]
+		v.offset = in.offset
+
+		depth := depths[i]
+		if depth < in.pops {
+			v.fail("stack underflow")
+			return
+		}
+		if in.slot >= depth {
+			v.fail("local slot %d out of range", in.slot)
+			return
+		}
+		depth += in.pushes - in.pops
+
+		var successors []int
+		switch in.op {
+		case OP_RETURN:
+		case OP_JUMP, OP_LOOP:
+			successors = []int{in.target}
+		case OP_JUMP_IF_FALSE:
+			successors = []int{in.next, in.target}
+		default:
+			successors = []int{in.next}
+		}
+		for _, offset := range successors {
+			if offset == v.chunk.count {
+				// The compiler always ends a function with OP_RETURN.
+				v.fail("execution runs past the end of the code")
+				return
+			}
+			j := v.index[offset]
+			if depths[j] == -1 {
+				depths[j] = depth
+				work = append(work, j)
+			} else if depths[j] != depth {
+				v.fail("stack depth %d at %d disagrees with %d", depth, offset, depths[j])
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package glox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const bytecodeSource = `
+class Greeter {
+	init(greeting) { this.greeting = greeting; }
+	greet(name) { return this.greeting + ", " + name + "!"; }
+}
+fun makeCounter() {
+	var count = 0;
+	fun next() { count = count + 1; return count; }
+	return next;
+}
+var counter = makeCounter();
+counter();
+print Greeter("Hello").greet("bytecode");
+print counter() * 1.5;
+counter() + 0.25;
+`
+
+func runCaptured(t *testing.T, options Options, run func(vm *VM) (Value, error)) (string, Value) {
+	var stdout strings.Builder
+	vm := new(VM)
+	vm.Options = options
+	vm.Options.Stdout = &stdout
+	vm.Init()
+	defer vm.Free()
+	value, err := run(vm)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	return stdout.String(), value
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	wantOutput, wantValue := runCaptured(t, Options{}, func(vm *VM) (Value, error) {
+		return vm.Interpret(ctx, bytecodeSource, "source")
+	})
+
+	compiler := new(VM)
+	compiler.Init()
+	data, err := compiler.Compile(bytecodeSource, "source")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	compiler.Free()
+
+	// Stress the collector so anything left unrooted while loading is lost.
+	output, value := runCaptured(t, Options{StressGC: true}, func(vm *VM) (Value, error) {
+		return vm.InterpretBytecode(ctx, data, "bytecode")
+	})
+	if output != wantOutput {
+		t.Errorf("Bytecode printed %q, source printed %q", output, wantOutput)
+	}
+	if value.AsNumber() != wantValue.AsNumber() || value.AsNumber() != 3.25 {
+		t.Errorf("Bytecode returned %v, source returned %v", value, wantValue)
+	}
+}
+
+func TestBytecodePositions(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	data, err := vm.Compile("var a = 1;\n\nprint a + nil;", "positions")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	_, err = vm.InterpretBytecode(context.Background(), data, "positions")
+	var runtimeError *RuntimeError
+	if !errors.As(err, &runtimeError) {
+		t.Fatalf("Expected a RuntimeError, got %v", err)
+	}
+	if frame := runtimeError.Frames[0]; frame.Line != 3 || frame.Column != 9 {
+		t.Errorf("Error reported at %v, want line 3:9", frame)
+	}
+	vm.Free()
+}
+
+func TestSourceStartingWithMagicText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "count.lox")
+	if err := ioutil.WriteFile(path, []byte("LOXCount();\nprint \"ran\";\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	output, _ := runCaptured(t, Options{}, func(vm *VM) (Value, error) {
+		vm.DefineNative("LOXCount", 0, func(args []Value) (Value, error) {
+			calls++
+			return NIL_VAL(), nil
+		})
+		return NIL_VAL(), vm.RunFile(path)
+	})
+	if calls != 1 || output != "ran\n" {
+		t.Errorf("Expected the file to run as source, got %d calls and %q", calls, output)
+	}
+}
+
+func TestRejectInvalidBytecode(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	data, err := vm.Compile(bytecodeSource, "source")
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	corrupt := func(change func(b []byte) []byte) []byte {
+		return change(append([]byte(nil), data...))
+	}
+	invalid := map[string][]byte{
+		"empty": {},
+		"magic": corrupt(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"version": corrupt(func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[len(BYTECODE_MAGIC):], BYTECODE_VERSION+1)
+			return b
+		}),
+		"checksum":  corrupt(func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }),
+		"truncated": corrupt(func(b []byte) []byte { return b[:len(b)-3] }),
+	}
+	for name, bad := range invalid {
+		if _, err := vm.InterpretBytecode(context.Background(), bad, name); !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: expected ErrInvalidBytecode, got %v", name, err)
+		}
+	}
+
+	// These all carry a valid header and checksum, so only the verifier
+	// stands between them and the dispatch loop.
+	assemble := func(upvalueCount int, constants []Value, code ...OpCode) *ObjFunction {
+		function := vm.newFunction()
+		function.upvalueCount = upvalueCount
+		for _, constant := range constants {
+			function.chunk.addConstant(constant)
+		}
+		for _, b := range code {
+			function.chunk.write(byte(b), 1, 1)
+		}
+		return function
+	}
+	withArity := func(arity int, function *ObjFunction) *ObjFunction {
+		function.arity = arity
+		return function
+	}
+	one := []Value{NUMBER_VAL(1)}
+	inner := OBJ_VAL(assemble(2, nil, OP_NIL, OP_RETURN))
+	local, long := OpCode(UPVALUE_LOCAL), OpCode(UPVALUE_LONG)
+
+	var out strings.Builder
+	vm.Options.Stdout = &out
+	valid := assemble(0, one, OP_CONSTANT, 0, OP_PRINT, OP_NIL, OP_RETURN)
+	if _, err := vm.InterpretBytecode(context.Background(), encodeBytecode(valid), "valid"); err != nil || out.String() != "1\n" {
+		t.Errorf("Expected hand-assembled bytecode to print 1, got %q (%v)", out.String(), err)
+	}
+
+	structural := map[string]*ObjFunction{
+		"unknown opcode":    assemble(0, nil, 0xff, OP_NIL, OP_RETURN),
+		"truncated operand": assemble(0, one, OP_NIL, OP_RETURN, OP_CONSTANT_LONG, 0),
+		"constant index":    assemble(0, one, OP_CONSTANT, 9, OP_PRINT, OP_NIL, OP_RETURN),
+		"name operand":      assemble(0, one, OP_GET_GLOBAL, 0, OP_PRINT, OP_NIL, OP_RETURN),
+		"upvalue operand":   assemble(0, nil, OP_GET_UPVALUE, 0, OP_RETURN),
+		"closure constant":  assemble(0, one, OP_CLOSURE, 0, OP_RETURN),
+		"closure overrun":   assemble(0, []Value{inner}, OP_NIL, OP_CLOSURE, 0, local, 1, local|long, 0),
+		"captured upvalue":  assemble(0, []Value{inner}, OP_CLOSURE, 0, local, 1, 0, 0, OP_RETURN),
+		"jump past end":     assemble(0, nil, OP_JUMP, 0, 10, OP_NIL, OP_RETURN),
+		"jump into operand": assemble(0, one, OP_JUMP, 0, 1, OP_CONSTANT, 0, OP_NIL, OP_RETURN),
+		"loop before start": assemble(0, nil, OP_NIL, OP_LOOP, 0, 9, OP_RETURN),
+		"missing return":    assemble(0, one, OP_CONSTANT, 0),
+		"script upvalues":   assemble(1, nil, OP_NIL, OP_RETURN),
+		"stack underflow":   assemble(0, nil, OP_POP, OP_POP, OP_NIL, OP_RETURN),
+		"local slot":        assemble(0, nil, OP_GET_LOCAL_LONG, 0xff, 0xff, 0xff, OP_RETURN),
+		"captured slot":     assemble(0, []Value{inner}, OP_CLOSURE, 0, local, 5, local, 0, OP_RETURN),
+		"depth mismatch":    assemble(0, nil, OP_TRUE, OP_JUMP_IF_FALSE, 0, 1, OP_NIL, OP_RETURN),
+		"script arguments":  withArity(1, assemble(0, nil, OP_GET_LOCAL, 1, OP_RETURN)),
+	}
+	for name, function := range structural {
+		if _, err := vm.InterpretBytecode(context.Background(), encodeBytecode(function), name); !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: expected ErrInvalidBytecode, got %v", name, err)
+		}
+	}
+
+	// Operand types are only known at run time, so these pass the verifier
+	// and fail as they run instead of crashing the VM.
+	names := []Value{OBJ_VAL(vm.allocateString("m"))}
+	mistyped := map[string]*ObjFunction{
+		"get super":    assemble(0, names, OP_NIL, OP_NIL, OP_GET_SUPER, 0, OP_RETURN),
+		"super invoke": assemble(0, names, OP_NIL, OP_NIL, OP_SUPER_INVOKE, 0, 0, OP_RETURN),
+		"inherit":      assemble(0, names, OP_CLASS, 0, OP_NIL, OP_INHERIT, OP_RETURN),
+		"method":       assemble(0, names, OP_CLASS, 0, OP_NIL, OP_METHOD, 0, OP_RETURN),
+	}
+	for name, function := range mistyped {
+		_, err := vm.InterpretBytecode(context.Background(), encodeBytecode(function), name)
+		var runtimeError *RuntimeError
+		if !errors.As(err, &runtimeError) {
+			t.Errorf("%s: expected a RuntimeError, got %v", name, err)
+		}
+	}
+
+	if _, err := vm.Compile("print ;", "broken"); err == nil {
+		t.Errorf("Expected Compile to report a CompileError")
+	}
+	vm.Free()
+}
@@ -1,18 +1,45 @@
 package glox
 
+import "sort"
+
 type OpCode byte
 
+// The _LONG variants of an instruction take a 24-bit big-endian operand in
+// place of the single byte used by the short form.
+const MAX_LONG_OPERAND = 1<<24 - 1
+
+// Each upvalue following OP_CLOSURE or OP_CLOSURE_LONG starts with a flags
+// byte. Its index is a single byte, or 24 bits when UPVALUE_LONG is set.
+const (
+	UPVALUE_LOCAL byte = 1 << iota
+	UPVALUE_LONG
+)
+
 const (
 	OP_CONSTANT OpCode = iota
+	OP_CONSTANT_LONG
 	OP_NIL
 	OP_TRUE
 	OP_FALSE
 	OP_POP
 	OP_GET_LOCAL
+	OP_GET_LOCAL_LONG
 	OP_SET_LOCAL
+	OP_SET_LOCAL_LONG
 	OP_GET_GLOBAL
+	OP_GET_GLOBAL_LONG
 	OP_DEFINE_GLOBAL
+	OP_DEFINE_GLOBAL_LONG
 	OP_SET_GLOBAL
+	OP_SET_GLOBAL_LONG
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
+	OP_GET_PROPERTY
+	OP_GET_PROPERTY_LONG
+	OP_SET_PROPERTY
+	OP_SET_PROPERTY_LONG
+	OP_GET_SUPER
+	OP_GET_SUPER_LONG
 	OP_EQUAL
 	OP_GREATER
 	OP_LESS
@@ -23,25 +50,70 @@ const (
 	OP_NOT
 	OP_NEGATE
 	OP_PRINT
+	OP_JUMP
+	OP_JUMP_IF_FALSE
+	OP_LOOP
+	OP_CALL
+	OP_INVOKE
+	OP_INVOKE_LONG
+	OP_SUPER_INVOKE
+	OP_SUPER_INVOKE_LONG
+	OP_CLOSURE
+	OP_CLOSURE_LONG
+	OP_CLOSE_UPVALUE
 	OP_RETURN
+	OP_CLASS
+	OP_CLASS_LONG
+	OP_INHERIT
+	OP_METHOD
+	OP_METHOD_LONG
 )
 
 type Chunk struct {
 	count       int
 	capacity    int
 	code        []byte
-	lines       []int
+	lines       []LineRun
 	currentCode int
 	constants   ValueArray
 }
 
-func (c *Chunk) write(b byte, line int) {
+// Position is a 1-based line and column in the source.
+type Position struct {
+	line   int
+	column int
+}
+
+// LineRun records that every byte from offset up to the start of the next
+// run was compiled from the same source position. Consecutive bytes almost
+// always share a position, so this is far smaller than one entry per byte.
+type LineRun struct {
+	offset int
+	Position
+}
+
+func (c *Chunk) write(b byte, line int, column int) {
+	position := Position{line, column}
+	if n := len(c.lines); n == 0 || c.lines[n-1].Position != position {
+		c.lines = append(c.lines, LineRun{len(c.code), position})
+	}
 	c.code = append(c.code, b)
-	c.lines = append(c.lines, line)
 	c.capacity = cap(c.code)
 	c.count = len(c.code)
 }
 
+// positionAt returns the source position of the byte at offset.
+func (c *Chunk) positionAt(offset int) Position {
+	// Find the last run starting at or before offset.
+	i := sort.Search(len(c.lines), func(i int) bool {
+		return c.lines[i].offset > offset
+	})
+	if i == 0 {
+		return Position{}
+	}
+	return c.lines[i-1].Position
+}
+
 func (c *Chunk) free() {
 	c = new(Chunk)
 }
@@ -1,29 +1,51 @@
 package glox
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestChunk(t *testing.T) {
 	chunk := new(Chunk)
 	chunk.writeConstant(12.34, 1)
-	chunk.write(byte(OP_RETURN), 1)
-	disassemble(chunk, "test chunk")
+	chunk.write(byte(OP_RETURN), 1, 1)
+	var out strings.Builder
+	disassemble(&out, chunk, "test chunk")
+	for _, want := range []string{"== test chunk ==", "OP_CONSTANT         0 '12.34'", "OP_RETURN"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Disassembly is missing %q:\n%s", want, out.String())
+		}
+	}
 }
 
 func (c *Chunk) writeConstant(v interface{}, line int) {
 	var constant int
 	switch t := v.(type) {
 	case float64:
-		constant = c.addConstant(Value{
-			valueType: VAL_NUMBER,
-			val:       t,
-		})
+		constant = c.addConstant(NUMBER_VAL(t))
 	case bool:
-		constant = c.addConstant(Value{
-			valueType: VAL_BOOL,
-			val:       t,
-		})
+		constant = c.addConstant(BOOL_VAL(t))
 	}
 
-	c.write(byte(OP_CONSTANT), line)
-	c.write(byte(constant), line)
+	c.write(byte(OP_CONSTANT), line, 1)
+	c.write(byte(constant), line, 1)
+}
+
+func TestPositionAt(t *testing.T) {
+	chunk := new(Chunk)
+	chunk.write(byte(OP_NIL), 1, 1)
+	chunk.write(byte(OP_NIL), 1, 1)
+	chunk.write(byte(OP_POP), 1, 5)
+	chunk.write(byte(OP_TRUE), 3, 2)
+	chunk.write(byte(OP_RETURN), 3, 2)
+
+	if len(chunk.lines) != 3 {
+		t.Errorf("Expected 3 line runs, found %d", len(chunk.lines))
+	}
+	expected := []Position{{1, 1}, {1, 1}, {1, 5}, {3, 2}, {3, 2}}
+	for offset, want := range expected {
+		if got := chunk.positionAt(offset); got != want {
+			t.Errorf("positionAt(%d) = %v, want %v", offset, got, want)
+		}
+	}
 }
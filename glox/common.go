@@ -1,4 +0,0 @@
-package glox
-
-var DEBUG_PRINT_CODE bool = true
-var DEBUG_TRACE_EXECUTION bool = true
@@ -1,27 +1,70 @@
 package glox
 
-import (
-	"fmt"
-	"math"
-	"os"
-)
+import "math"
 
+// Parser holds the state of a single compilation. Nothing is shared between
+// compilations apart from the read-only rules table, so separate VMs can
+// compile concurrently.
 type Parser struct {
 	current   Token
 	previous  Token
 	hadError  bool
 	panicMode bool
+	// diagnostics collects every error reported, one per synchronization.
+	diagnostics []Diagnostic
+
+	vm           *VM
+	scanner      Scanner
+	compiler     *Compiler
+	currentClass *ClassCompiler
 }
 
 type Local struct {
-	name  Token
-	depth int
+	name       Token
+	depth      int
+	isCaptured bool
+}
+
+type Upvalue struct {
+	index   int
+	isLocal bool
 }
 
+type Loop struct {
+	enclosing  *Loop
+	start      int
+	scopeDepth int
+	breakJumps []int
+}
+
+type FunctionType byte
+
+const (
+	TYPE_FUNCTION FunctionType = iota
+	TYPE_INITIALIZER
+	TYPE_METHOD
+	TYPE_SCRIPT
+)
+
 type Compiler struct {
+	enclosing  *Compiler
+	function   *ObjFunction
+	fnType     FunctionType
 	locals     []Local
 	localCount int
+	upvalues   []Upvalue
 	scopeDepth int
+	loop       *Loop
+
+	// Constant pool slots already holding a given string or number, so
+	// repeated names and literals share one entry.
+	stringConstants map[*ObjString]int
+	numberConstants map[uint64]int
+}
+
+type ClassCompiler struct {
+	enclosing     *ClassCompiler
+	hasSuperclass bool
 }
 
 type Precedence byte
@@ -40,7 +83,7 @@ const (
 	PREC_PRIMARY
 )
 
-type ParseFn func(bool)
+type ParseFn func(*Parser, bool)
 
 type ParseRule struct {
 	prefix     ParseFn
@@ -48,60 +91,83 @@ type ParseRule struct {
 	precedence Precedence
 }
 
-var parser = &Parser{
-	hadError:  false,
-	panicMode: false,
-}
-
-var current *Compiler
-var compilingChunk *Chunk
-var scanner *Scanner
-var vm *VM
-
 var rules map[TokenType]ParseRule
 
-func (v *VM) compile(source string, chunk *Chunk) bool {
-	vm = v
-	scanner = new(Scanner)
-	scanner.init(source)
+// compile returns the top-level function for source, or nil and the errors
+// found if it doesn't compile.
+func (vm *VM) compile(source string) (*ObjFunction, []Diagnostic) {
+	p := &Parser{vm: vm}
+	p.scanner.init(source)
+
+	// The functions being compiled are GC roots until compilation ends.
+	vm.parser = p
+	defer func() { vm.parser = nil }()
 
 	compiler := new(Compiler)
-	compiler.init()
+	p.initCompiler(compiler, TYPE_SCRIPT)
 
-	compilingChunk = chunk
-	parser.advance()
+	p.advance()
 
-	for !parser.match(TOKEN_EOF) {
-		parser.declaration()
+	for !p.match(TOKEN_EOF) {
+		p.declaration()
 	}
 
-	parser.endCompiler()
-	return !parser.hadError
+	function := p.endCompiler()
+	if p.hadError {
+		return nil, p.diagnostics
+	}
+	return function, nil
 }
 
-func (c *Compiler) init() {
+func (p *Parser) initCompiler(c *Compiler, fnType FunctionType) {
+	c.enclosing = p.compiler
+	c.function = p.vm.newFunction()
+	c.fnType = fnType
 	c.localCount = 0
 	c.scopeDepth = 0
-	current = c
+	c.loop = nil
+	c.stringConstants = make(map[*ObjString]int)
+	c.numberConstants = make(map[uint64]int)
+	p.compiler = c
+
+	if fnType != TYPE_SCRIPT {
+		p.compiler.function.name = p.vm.allocateString(p.previous.lexeme)
+	}
+
+	// The first slot is claimed by the function being called, or by the
+	// receiver inside methods. Scripts use it to hold their result.
+	local := Local{
+		name:  Token{lexeme: ""},
+		depth: 0,
+	}
+	if fnType != TYPE_FUNCTION && fnType != TYPE_SCRIPT {
+		local.name.lexeme = "this"
+	}
+	p.compiler.locals = append(p.compiler.locals, local)
+	p.compiler.localCount++
 }
 
 func (p *Parser) advance() {
 	p.previous = p.current
 	for {
-		p.current = scanner.scanToken()
+		p.current = p.scanner.scanToken()
 		if p.current.tokenType != TOKEN_ERROR {
 			break
 		}
-		errorAtCurrent(p.current.lexeme)
+		p.errorAtCurrent(p.current.lexeme)
 	}
 }
 
 func (p *Parser) expression() {
-	parsePrecedence(PREC_ASSIGNMENT)
+	p.parsePrecedence(PREC_ASSIGNMENT)
 }
 
 func (p *Parser) declaration() {
-	if p.match(TOKEN_VAR) {
+	if p.match(TOKEN_CLASS) {
+		p.classDeclaration()
+	} else if p.match(TOKEN_FUN) {
+		p.funDeclaration()
+	} else if p.match(TOKEN_VAR) {
 		p.varDeclaration()
 	} else {
 		p.statement()
@@ -115,6 +181,18 @@ func (p *Parser) declaration() {
 func (p *Parser) statement() {
 	if p.match(TOKEN_PRINT) {
 		p.printStatement()
+	} else if p.match(TOKEN_BREAK) {
+		p.breakStatement()
+	} else if p.match(TOKEN_CONTINUE) {
+		p.continueStatement()
+	} else if p.match(TOKEN_FOR) {
+		p.forStatement()
+	} else if p.match(TOKEN_IF) {
+		p.ifStatement()
+	} else if p.match(TOKEN_RETURN) {
+		p.returnStatement()
+	} else if p.match(TOKEN_WHILE) {
+		p.whileStatement()
 	} else if p.match(TOKEN_LEFT_BRACE) {
 		p.beginScope()
 		p.block()
@@ -133,22 +211,138 @@ func (p *Parser) block() {
 }
 
 func (p *Parser) beginScope() {
-	current.scopeDepth++
+	p.compiler.scopeDepth++
 }
 
 func (p *Parser) endScope() {
-	current.scopeDepth--
+	p.compiler.scopeDepth--
 
-	for current.localCount > 0 && current.locals[current.localCount-1].depth > current.scopeDepth {
-		emitByte(byte(OP_POP))
-		current.localCount--
+	for p.compiler.localCount > 0 && p.compiler.locals[p.compiler.localCount-1].depth > p.compiler.scopeDepth {
+		if p.compiler.locals[p.compiler.localCount-1].isCaptured {
+			p.emitByte(byte(OP_CLOSE_UPVALUE))
+		} else {
+			p.emitByte(byte(OP_POP))
+		}
+		p.compiler.localCount--
 	}
+	p.compiler.locals = p.compiler.locals[:p.compiler.localCount]
 }
 
 func (p *Parser) expressionStatement() {
 	p.expression()
 	p.consume(TOKEN_SEMICOLON, "Expect ';' after value.")
-	emitByte(byte(OP_POP))
+	if p.compiler.fnType == TYPE_SCRIPT {
+		// Keep the value of every expression statement the script runs
+		// outside a function, however deeply nested in blocks, in its
+		// unnamed slot 0 so the last one becomes the script's result.
+		p.emitBytes(byte(OP_SET_LOCAL), 0)
+	}
+	p.emitByte(byte(OP_POP))
+}
+
+func (p *Parser) function(fnType FunctionType) {
+	compiler := new(Compiler)
+	p.initCompiler(compiler, fnType)
+	p.beginScope()
+
+	p.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	if !p.check(TOKEN_RIGHT_PAREN) {
+		for {
+			p.compiler.function.arity++
+			if p.compiler.function.arity > math.MaxUint8 {
+				p.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			constant := p.parseVariable("Expect parameter name.")
+			p.defineVariable(constant)
+			if !p.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	p.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	p.block()
+
+	function := p.endCompiler()
+	p.emitOperand(OP_CLOSURE, OP_CLOSURE_LONG, p.makeConstant(OBJ_VAL(function)))
+
+	for _, upvalue := range compiler.upvalues {
+		var flags byte
+		if upvalue.isLocal {
+			flags |= UPVALUE_LOCAL
+		}
+		if upvalue.index > math.MaxUint8 {
+			p.emitBytes(flags|UPVALUE_LONG, byte((upvalue.index>>16)&0xff))
+			p.emitBytes(byte((upvalue.index>>8)&0xff), byte(upvalue.index&0xff))
+		} else {
+			p.emitBytes(flags, byte(upvalue.index))
+		}
+	}
+}
+
+func (p *Parser) classDeclaration() {
+	p.consume(TOKEN_IDENTIFIER, "Expect class name.")
+	nameConstant := p.identifierConstant(&p.previous)
+	p.declareVariable()
+
+	className := p.previous
+	p.emitOperand(OP_CLASS, OP_CLASS_LONG, nameConstant)
+	p.defineVariable(nameConstant)
+
+	classCompiler := &ClassCompiler{
+		enclosing: p.currentClass,
+	}
+	p.currentClass = classCompiler
+
+	if p.match(TOKEN_LESS) {
+		p.consume(TOKEN_IDENTIFIER, "Expect superclass name.")
+		p.variable(false)
+
+		if className.identifierEqual(&p.previous) {
+			p.errorAtPrevious("A class can't inherit from itself.")
+		}
+
+		p.beginScope()
+		p.addLocal(p.syntheticToken("super"))
+		p.defineVariable(0)
+
+		p.namedVariable(&className, false)
+		p.emitByte(byte(OP_INHERIT))
+		classCompiler.hasSuperclass = true
+	}
+
+	p.namedVariable(&className, false)
+	p.consume(TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	for !p.check(TOKEN_RIGHT_BRACE) && !p.check(TOKEN_EOF) {
+		p.method()
+	}
+	p.consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	p.emitByte(byte(OP_POP))
+
+	if classCompiler.hasSuperclass {
+		p.endScope()
+	}
+
+	p.currentClass = p.currentClass.enclosing
+}
+
+func (p *Parser) method() {
+	p.consume(TOKEN_IDENTIFIER, "Expect method name.")
+	constant := p.identifierConstant(&p.previous)
+
+	fnType := TYPE_METHOD
+	if p.previous.lexeme == "init" {
+		fnType = TYPE_INITIALIZER
+	}
+	p.function(fnType)
+	p.emitOperand(OP_METHOD, OP_METHOD_LONG, constant)
+}
+
+func (p *Parser) funDeclaration() {
+	global := p.parseVariable("Expect function name.")
+	p.markInitialized()
+	p.function(TYPE_FUNCTION)
+	p.defineVariable(global)
 }
 
 func (p *Parser) varDeclaration() {
@@ -157,17 +351,175 @@ func (p *Parser) varDeclaration() {
 	if p.match(TOKEN_EQUAL) {
 		p.expression()
 	} else {
-		emitByte(byte(OP_NIL))
+		p.emitByte(byte(OP_NIL))
 	}
 	p.consume(TOKEN_SEMICOLON, "Expect ';' after value.")
 
 	p.defineVariable(global)
 }
 
+func (p *Parser) forStatement() {
+	p.beginScope()
+	p.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if p.match(TOKEN_SEMICOLON) {
+		// No initializer.
+	} else if p.match(TOKEN_VAR) {
+		p.varDeclaration()
+	} else {
+		p.expressionStatement()
+	}
+
+	loopStart := p.currentChunk().count
+	exitJump := -1
+	if !p.match(TOKEN_SEMICOLON) {
+		p.expression()
+		p.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+
+		// Jump out of the loop if the condition is false.
+		exitJump = p.emitJump(byte(OP_JUMP_IF_FALSE))
+		p.emitByte(byte(OP_POP))
+	}
+
+	if !p.match(TOKEN_RIGHT_PAREN) {
+		bodyJump := p.emitJump(byte(OP_JUMP))
+
+		incrementStart := p.currentChunk().count
+		p.expression()
+		p.emitByte(byte(OP_POP))
+		p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+
+		p.emitLoop(loopStart)
+		loopStart = incrementStart
+		p.patchJump(bodyJump)
+	}
+
+	p.beginLoop(loopStart)
+	p.statement()
+	p.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		p.patchJump(exitJump)
+		p.emitByte(byte(OP_POP))
+	}
+	p.endLoop()
+
+	p.endScope()
+}
+
+func (p *Parser) whileStatement() {
+	loopStart := p.currentChunk().count
+	p.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	p.expression()
+	p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	exitJump := p.emitJump(byte(OP_JUMP_IF_FALSE))
+	p.emitByte(byte(OP_POP))
+	p.beginLoop(loopStart)
+	p.statement()
+	p.emitLoop(loopStart)
+
+	p.patchJump(exitJump)
+	p.emitByte(byte(OP_POP))
+	p.endLoop()
+}
+
+func (p *Parser) breakStatement() {
+	if p.compiler.loop == nil {
+		p.errorAtPrevious("Can't use 'break' outside of a loop.")
+	}
+	p.consume(TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+	if p.compiler.loop == nil {
+		return
+	}
+
+	p.discardLoopLocals()
+	p.compiler.loop.breakJumps = append(p.compiler.loop.breakJumps, p.emitJump(byte(OP_JUMP)))
+}
+
+func (p *Parser) continueStatement() {
+	if p.compiler.loop == nil {
+		p.errorAtPrevious("Can't use 'continue' outside of a loop.")
+	}
+	p.consume(TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+	if p.compiler.loop == nil {
+		return
+	}
+
+	p.discardLoopLocals()
+	p.emitLoop(p.compiler.loop.start)
+}
+
+func (p *Parser) beginLoop(start int) {
+	loop := &Loop{
+		enclosing:  p.compiler.loop,
+		start:      start,
+		scopeDepth: p.compiler.scopeDepth,
+	}
+	p.compiler.loop = loop
+}
+
+func (p *Parser) endLoop() {
+	for _, jump := range p.compiler.loop.breakJumps {
+		p.patchJump(jump)
+	}
+	p.compiler.loop = p.compiler.loop.enclosing
+}
+
+// discardLoopLocals pops the locals declared inside the innermost loop body
+// without removing them from the compiler, since the code following a break
+// or continue in the same block still refers to them.
+func (p *Parser) discardLoopLocals() {
+	for i := p.compiler.localCount - 1; i >= 0 && p.compiler.locals[i].depth > p.compiler.loop.scopeDepth; i-- {
+		if p.compiler.locals[i].isCaptured {
+			p.emitByte(byte(OP_CLOSE_UPVALUE))
+		} else {
+			p.emitByte(byte(OP_POP))
+		}
+	}
+}
+
+func (p *Parser) ifStatement() {
+	p.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	p.expression()
+	p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	thenJump := p.emitJump(byte(OP_JUMP_IF_FALSE))
+	p.emitByte(byte(OP_POP))
+	p.statement()
+
+	elseJump := p.emitJump(byte(OP_JUMP))
+
+	p.patchJump(thenJump)
+	p.emitByte(byte(OP_POP))
+
+	if p.match(TOKEN_ELSE) {
+		p.statement()
+	}
+	p.patchJump(elseJump)
+}
+
+func (p *Parser) returnStatement() {
+	if p.compiler.fnType == TYPE_SCRIPT {
+		p.errorAtPrevious("Can't return from top-level code.")
+	}
+
+	if p.match(TOKEN_SEMICOLON) {
+		p.emitReturn()
+	} else {
+		if p.compiler.fnType == TYPE_INITIALIZER {
+			p.errorAtPrevious("Can't return a value from an initializer.")
+		}
+
+		p.expression()
+		p.consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
+		p.emitByte(byte(OP_RETURN))
+	}
+}
+
 func (p *Parser) printStatement() {
 	p.expression()
 	p.consume(TOKEN_SEMICOLON, "Expect ';' after value.")
-	emitByte(byte(OP_PRINT))
+	p.emitByte(byte(OP_PRINT))
 }
 
 func (p *Parser) synchronize() {
@@ -186,6 +538,10 @@ func (p *Parser) synchronize() {
 			return
 		case TOKEN_FOR:
 			return
+		case TOKEN_BREAK:
+			return
+		case TOKEN_CONTINUE:
+			return
 		case TOKEN_IF:
 			return
 		case TOKEN_WHILE:
@@ -212,312 +568,569 @@ func (p *Parser) check(t TokenType) bool {
 	return p.current.tokenType == t
 }
 
-func parsePrecedence(p Precedence) {
-	parser.advance()
-	prefix := rules[parser.previous.tokenType].prefix
+func (p *Parser) parsePrecedence(precedence Precedence) {
+	p.advance()
+	prefix := rules[p.previous.tokenType].prefix
 	if prefix == nil {
-		errorAtPrevious("Expect expression.")
+		p.errorAtPrevious("Expect expression.")
 		return
 	}
 
-	canAssign := p <= PREC_ASSIGNMENT
-	prefix(canAssign)
+	canAssign := precedence <= PREC_ASSIGNMENT
+	prefix(p, canAssign)
 
-	for p <= rules[parser.current.tokenType].precedence {
-		parser.advance()
-		infix := rules[parser.previous.tokenType].infix
-		infix(canAssign)
+	for precedence <= rules[p.current.tokenType].precedence {
+		p.advance()
+		infix := rules[p.previous.tokenType].infix
+		infix(p, canAssign)
 	}
 
-	if canAssign && parser.match(TOKEN_EQUAL) {
-		errorAtPrevious("Invalid assignment target.")
+	if canAssign && p.match(TOKEN_EQUAL) {
+		p.errorAtPrevious("Invalid assignment target.")
+	}
+}
+
+func (p *Parser) markInitialized() {
+	if p.compiler.scopeDepth == 0 {
+		return
 	}
+	p.compiler.locals[p.compiler.localCount-1].depth = p.compiler.scopeDepth
 }
 
-func (p *Parser) defineVariable(global byte) {
-	if current.scopeDepth > 0 {
+func (p *Parser) defineVariable(global int) {
+	if p.compiler.scopeDepth > 0 {
+		p.markInitialized()
 		return
 	}
 
-	emitBytes(byte(OP_DEFINE_GLOBAL), global)
+	p.emitOperand(OP_DEFINE_GLOBAL, OP_DEFINE_GLOBAL_LONG, global)
 }
 
-func (p *Parser) parseVariable(errorMsg string) byte {
+func (p *Parser) parseVariable(errorMsg string) int {
 	p.consume(TOKEN_IDENTIFIER, errorMsg)
 
 	p.declareVariable()
-	if current.scopeDepth > 0 {
+	if p.compiler.scopeDepth > 0 {
 		return 0
 	}
 
-	return p.previous.identifierConstant()
+	return p.identifierConstant(&p.previous)
 }
 
-func (t *Token) identifierConstant() byte {
-	name := t.lexeme
-	return makeConstant(OBJ_VAL(newObjString(name)))
+func (p *Parser) identifierConstant(name *Token) int {
+	return p.makeConstant(OBJ_VAL(p.vm.allocateString(name.lexeme)))
+}
+
+func (p *Parser) syntheticToken(text string) *Token {
+	return &Token{
+		tokenType: TOKEN_IDENTIFIER,
+		lexeme:    text,
+		line:      p.previous.line,
+		column:    p.previous.column,
+	}
 }
 
 func (a *Token) identifierEqual(b *Token) bool {
 	return a.lexeme == b.lexeme
 }
 
-func (t *Token) addLocal() {
-	if current.localCount == math.MaxUint8 {
-		errorAtPrevious("Too many local variables in function.")
+func (p *Parser) addLocal(name *Token) {
+	if p.compiler.localCount == MAX_LONG_OPERAND+1 {
+		p.errorAtPrevious("Too many local variables in function.")
 		return
 	}
 
 	local := Local{
-		name:  *t,
-		depth: current.scopeDepth,
+		name:  *name,
+		depth: -1,
 	}
-	current.locals = append(current.locals, local)
-	current.localCount++
+	p.compiler.locals = append(p.compiler.locals, local)
+	p.compiler.localCount++
 }
 
 func (p *Parser) declareVariable() {
-	if current.scopeDepth == 0 {
+	if p.compiler.scopeDepth == 0 {
 		return
 	}
 	name := p.previous
 
-	for i := current.localCount - 1; i >= 0; i-- {
-		l := current.locals[i]
-		if l.depth != -1 && l.depth < current.scopeDepth {
+	for i := p.compiler.localCount - 1; i >= 0; i-- {
+		l := p.compiler.locals[i]
+		if l.depth != -1 && l.depth < p.compiler.scopeDepth {
 			break
 		}
 
 		if name.identifierEqual(&l.name) {
-			errorAtPrevious("Already variable with this name in this scope.")
+			p.errorAtPrevious("Already variable with this name in this scope.")
 		}
 	}
 
-	name.addLocal()
+	p.addLocal(&name)
 }
 
-func (t *Token) namedVariable(canAssign bool) {
-	var getOp, setOp byte
-	arg, ok := t.resolveLocal(current)
+func (p *Parser) namedVariable(name *Token, canAssign bool) {
+	var getOp, getLongOp, setOp, setLongOp OpCode
+	arg, ok := p.resolveLocal(p.compiler, name)
 	if ok {
-		getOp = byte(OP_GET_LOCAL)
-		setOp = byte(OP_SET_LOCAL)
+		getOp, getLongOp = OP_GET_LOCAL, OP_GET_LOCAL_LONG
+		setOp, setLongOp = OP_SET_LOCAL, OP_SET_LOCAL_LONG
+	} else if arg, ok = p.resolveUpvalue(p.compiler, name); ok {
+		// Upvalue indexes always fit in a byte, so there is no long form.
+		getOp, getLongOp = OP_GET_UPVALUE, OP_GET_UPVALUE
+		setOp, setLongOp = OP_SET_UPVALUE, OP_SET_UPVALUE
 	} else {
-		arg = t.identifierConstant()
-		getOp = byte(OP_GET_GLOBAL)
-		setOp = byte(OP_SET_GLOBAL)
+		arg = p.identifierConstant(name)
+		getOp, getLongOp = OP_GET_GLOBAL, OP_GET_GLOBAL_LONG
+		setOp, setLongOp = OP_SET_GLOBAL, OP_SET_GLOBAL_LONG
 	}
 
-	if canAssign && parser.match(TOKEN_EQUAL) {
-		parser.expression()
-		emitBytes(setOp, arg)
+	if canAssign && p.match(TOKEN_EQUAL) {
+		p.expression()
+		p.emitOperand(setOp, setLongOp, arg)
 	} else {
-		emitBytes(getOp, arg)
+		p.emitOperand(getOp, getLongOp, arg)
 	}
 }
 
-func (name *Token) resolveLocal(compile *Compiler) (byte, bool) {
-	for i := current.localCount - 1; i >= 0; i-- {
-		l := current.locals[i]
+func (p *Parser) resolveLocal(compiler *Compiler, name *Token) (int, bool) {
+	for i := compiler.localCount - 1; i >= 0; i-- {
+		l := compiler.locals[i]
 		if name.identifierEqual(&l.name) {
-			return byte(i), true
+			if l.depth == -1 {
+				p.errorAtPrevious("Can't read local variable in its own initializer.")
+			}
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (p *Parser) resolveUpvalue(compiler *Compiler, name *Token) (int, bool) {
+	if compiler.enclosing == nil {
+		return 0, false
+	}
+
+	if local, ok := p.resolveLocal(compiler.enclosing, name); ok {
+		compiler.enclosing.locals[local].isCaptured = true
+		return p.addUpvalue(compiler, local, true), true
+	}
+
+	if upvalue, ok := p.resolveUpvalue(compiler.enclosing, name); ok {
+		return p.addUpvalue(compiler, upvalue, false), true
+	}
+
+	return 0, false
+}
+
+func (p *Parser) addUpvalue(c *Compiler, index int, isLocal bool) int {
+	for i, upvalue := range c.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
 		}
 	}
-	return byte(0), false
+
+	if len(c.upvalues) == math.MaxUint8+1 {
+		p.errorAtPrevious("Too many closure variables in function.")
+		return 0
+	}
+
+	c.upvalues = append(c.upvalues, Upvalue{index: index, isLocal: isLocal})
+	c.function.upvalueCount = len(c.upvalues)
+	return c.function.upvalueCount - 1
 }
 
-func number(canAssign bool) {
-	value := NUMBER_VAL(parser.previous.literal.(float64))
-	emitConstant(value)
+func (p *Parser) number(canAssign bool) {
+	value := NUMBER_VAL(p.previous.literal.(float64))
+	p.emitConstant(value)
 }
 
-func grouping(canAssign bool) {
-	parser.expression()
-	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+func (p *Parser) grouping(canAssign bool) {
+	p.expression()
+	p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
-func unary(canAssign bool) {
-	operator := parser.previous.tokenType
+func (p *Parser) unary(canAssign bool) {
+	operator := p.previous
 
-	parsePrecedence(PREC_UNARY)
+	p.parsePrecedence(PREC_UNARY)
 
-	switch operator {
+	switch operator.tokenType {
 	case TOKEN_BANG:
-		emitByte(byte(OP_NOT))
+		p.emitByteAt(&operator, byte(OP_NOT))
 	case TOKEN_MINUS:
-		emitByte(byte(OP_NEGATE))
+		p.emitByteAt(&operator, byte(OP_NEGATE))
 	default:
 		return
 	}
 }
 
-func binary(canAssign bool) {
-	operator := parser.previous.tokenType
+func (p *Parser) binary(canAssign bool) {
+	operator := p.previous
 
-	parsePrecedence(rules[operator].precedence + 1)
+	p.parsePrecedence(rules[operator.tokenType].precedence + 1)
 
-	switch operator {
+	switch operator.tokenType {
 	case TOKEN_BANG_EQUAL:
-		emitBytes(byte(OP_EQUAL), byte(OP_NOT))
+		p.emitBytesAt(&operator, byte(OP_EQUAL), byte(OP_NOT))
 	case TOKEN_EQUAL_EQUAL:
-		emitByte(byte(OP_EQUAL))
+		p.emitByteAt(&operator, byte(OP_EQUAL))
 	case TOKEN_GREATER_EQUAL:
-		emitBytes(byte(OP_LESS), byte(OP_NOT))
+		p.emitBytesAt(&operator, byte(OP_LESS), byte(OP_NOT))
 	case TOKEN_GREATER:
-		emitByte(byte(OP_GREATER))
+		p.emitByteAt(&operator, byte(OP_GREATER))
 	case TOKEN_LESS_EQUAL:
-		emitBytes(byte(OP_GREATER), byte(OP_NOT))
+		p.emitBytesAt(&operator, byte(OP_GREATER), byte(OP_NOT))
 	case TOKEN_LESS:
-		emitByte(byte(OP_LESS))
+		p.emitByteAt(&operator, byte(OP_LESS))
 	case TOKEN_PLUS:
-		emitByte(byte(OP_ADD))
+		p.emitByteAt(&operator, byte(OP_ADD))
 	case TOKEN_MINUS:
-		emitByte(byte(OP_SUBSTRACT))
+		p.emitByteAt(&operator, byte(OP_SUBSTRACT))
 	case TOKEN_STAR:
-		emitByte(byte(OP_MULTIPLY))
+		p.emitByteAt(&operator, byte(OP_MULTIPLY))
 	case TOKEN_SLASH:
-		emitByte(byte(OP_DIVIDE))
+		p.emitByteAt(&operator, byte(OP_DIVIDE))
 	default:
 		return
 	}
 
 }
 
-func literal(canAssign bool) {
-	switch parser.previous.tokenType {
+func (p *Parser) call(canAssign bool) {
+	paren := p.previous
+	argCount := p.argumentList()
+	p.emitBytesAt(&paren, byte(OP_CALL), argCount)
+}
+
+func (p *Parser) argumentList() byte {
+	argCount := 0
+	if !p.check(TOKEN_RIGHT_PAREN) {
+		for {
+			p.expression()
+			if argCount == math.MaxUint8 {
+				p.errorAtPrevious("Can't have more than 255 arguments.")
+			}
+			argCount++
+			if !p.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	p.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+	return byte(argCount)
+}
+
+func (p *Parser) dot(canAssign bool) {
+	dot := p.previous
+	p.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	name := p.identifierConstant(&p.previous)
+
+	if canAssign && p.match(TOKEN_EQUAL) {
+		p.expression()
+		p.emitOperandAt(&dot, OP_SET_PROPERTY, OP_SET_PROPERTY_LONG, name)
+	} else if p.match(TOKEN_LEFT_PAREN) {
+		argCount := p.argumentList()
+		p.emitOperandAt(&dot, OP_INVOKE, OP_INVOKE_LONG, name)
+		p.emitByteAt(&dot, argCount)
+	} else {
+		p.emitOperandAt(&dot, OP_GET_PROPERTY, OP_GET_PROPERTY_LONG, name)
+	}
+}
+
+func (p *Parser) and_(canAssign bool) {
+	operator := p.previous
+	endJump := p.emitJumpAt(&operator, byte(OP_JUMP_IF_FALSE))
+
+	p.emitByteAt(&operator, byte(OP_POP))
+	p.parsePrecedence(PREC_AND)
+
+	p.patchJump(endJump)
+}
+
+func (p *Parser) or_(canAssign bool) {
+	operator := p.previous
+	elseJump := p.emitJumpAt(&operator, byte(OP_JUMP_IF_FALSE))
+	endJump := p.emitJumpAt(&operator, byte(OP_JUMP))
+
+	p.patchJump(elseJump)
+	p.emitByteAt(&operator, byte(OP_POP))
+
+	p.parsePrecedence(PREC_OR)
+	p.patchJump(endJump)
+}
+
+func (p *Parser) literal(canAssign bool) {
+	switch p.previous.tokenType {
 	case TOKEN_FALSE:
-		emitByte(byte(OP_FALSE))
+		p.emitByte(byte(OP_FALSE))
 	case TOKEN_NIL:
-		emitByte(byte(OP_NIL))
+		p.emitByte(byte(OP_NIL))
 	case TOKEN_TRUE:
-		emitByte(byte(OP_TRUE))
+		p.emitByte(byte(OP_TRUE))
 	default:
 		return
 	}
 }
 
-func gstring(canAssign bool) {
-	str := parser.previous.literal.(string)
-	emitConstant(OBJ_VAL(newObjString(str)))
+func (p *Parser) gstring(canAssign bool) {
+	str := p.previous.literal.(string)
+	p.emitConstant(OBJ_VAL(p.vm.allocateString(str)))
 }
 
-func variable(canAssign bool) {
-	parser.previous.namedVariable(canAssign)
+func (p *Parser) variable(canAssign bool) {
+	p.namedVariable(&p.previous, canAssign)
+}
+
+func (p *Parser) super_(canAssign bool) {
+	if p.currentClass == nil {
+		p.errorAtPrevious("Can't use 'super' outside of a class.")
+	} else if !p.currentClass.hasSuperclass {
+		p.errorAtPrevious("Can't use 'super' in a class with no superclass.")
+	}
+
+	p.consume(TOKEN_DOT, "Expect '.' after 'super'.")
+	p.consume(TOKEN_IDENTIFIER, "Expect superclass method name.")
+	name := p.identifierConstant(&p.previous)
+
+	thisToken := p.syntheticToken("this")
+	p.namedVariable(thisToken, false)
+	superToken := p.syntheticToken("super")
+	if p.match(TOKEN_LEFT_PAREN) {
+		argCount := p.argumentList()
+		p.namedVariable(superToken, false)
+		p.emitOperand(OP_SUPER_INVOKE, OP_SUPER_INVOKE_LONG, name)
+		p.emitByte(argCount)
+	} else {
+		p.namedVariable(superToken, false)
+		p.emitOperand(OP_GET_SUPER, OP_GET_SUPER_LONG, name)
+	}
+}
+
+func (p *Parser) this_(canAssign bool) {
+	if p.currentClass == nil {
+		p.errorAtPrevious("Can't use 'this' outside of a class.")
+		return
+	}
+
+	p.variable(false)
 }
 
 func (p *Parser) consume(t TokenType, msg string) {
-	if parser.current.tokenType == t {
+	if p.current.tokenType == t {
 		p.advance()
 		return
 	}
-	errorAtCurrent(msg)
+	p.errorAtCurrent(msg)
 }
 
-func (p *Parser) endCompiler() {
-	emitReturn()
-	if DEBUG_PRINT_CODE {
-		if !parser.hadError {
-			disassemble(currentChunk(), "code")
+func (p *Parser) endCompiler() *ObjFunction {
+	p.emitReturn()
+	function := p.compiler.function
+
+	if p.vm.Options.Disassemble && !p.hadError {
+		name := "<script>"
+		if function.name != nil {
+			name = function.name.str
 		}
+		disassemble(p.vm.Options.debugOutput(), p.currentChunk(), name)
 	}
+
+	p.compiler = p.compiler.enclosing
+	return function
+}
+
+func (p *Parser) emitConstant(value Value) {
+	p.emitOperand(OP_CONSTANT, OP_CONSTANT_LONG, p.makeConstant(value))
+}
+
+// emitOperand emits the short form of an instruction when the operand fits in
+// a byte and the 24-bit long form otherwise.
+func (p *Parser) emitOperand(op OpCode, longOp OpCode, operand int) {
+	p.emitOperandAt(&p.previous, op, longOp, operand)
 }
 
-func emitConstant(value Value) {
-	emitBytes(byte(OP_CONSTANT), makeConstant(value))
+func (p *Parser) emitOperandAt(token *Token, op OpCode, longOp OpCode, operand int) {
+	if operand <= math.MaxUint8 {
+		p.emitBytesAt(token, byte(op), byte(operand))
+		return
+	}
+
+	p.emitByteAt(token, byte(longOp))
+	p.emitByteAt(token, byte((operand>>16)&0xff))
+	p.emitByteAt(token, byte((operand>>8)&0xff))
+	p.emitByteAt(token, byte(operand&0xff))
 }
 
-func emitReturn() {
-	emitByte(byte(OP_RETURN))
+func (p *Parser) emitLoop(loopStart int) {
+	p.emitByte(byte(OP_LOOP))
+
+	offset := p.currentChunk().count - loopStart + 2
+	if offset > math.MaxUint16 {
+		p.errorAtPrevious("Loop body too large.")
+	}
+
+	p.emitByte(byte((offset >> 8) & 0xff))
+	p.emitByte(byte(offset & 0xff))
 }
 
-func emitByte(b byte) {
-	currentChunk().write(b, parser.previous.line)
+func (p *Parser) emitJump(instruction byte) int {
+	return p.emitJumpAt(&p.previous, instruction)
 }
 
-func emitBytes(b1 byte, b2 byte) {
-	emitByte(b1)
-	emitByte(b2)
+func (p *Parser) emitJumpAt(token *Token, instruction byte) int {
+	p.emitByteAt(token, instruction)
+	p.emitByteAt(token, 0xff)
+	p.emitByteAt(token, 0xff)
+	return p.currentChunk().count - 2
 }
 
-func makeConstant(value Value) byte {
-	constant := compilingChunk.addConstant(value)
-	if constant > math.MaxUint8 {
-		errorAtPrevious("Too many constants in one chunk.")
-		return 0
+func (p *Parser) patchJump(offset int) {
+	// -2 to adjust for the bytecode for the jump offset itself.
+	jump := p.currentChunk().count - offset - 2
+
+	if jump > math.MaxUint16 {
+		p.errorAtPrevious("Too much code to jump over.")
+	}
+
+	p.currentChunk().code[offset] = byte((jump >> 8) & 0xff)
+	p.currentChunk().code[offset+1] = byte(jump & 0xff)
+}
+
+func (p *Parser) emitReturn() {
+	if p.compiler.fnType == TYPE_INITIALIZER || p.compiler.fnType == TYPE_SCRIPT {
+		p.emitBytes(byte(OP_GET_LOCAL), 0)
+	} else {
+		p.emitByte(byte(OP_NIL))
 	}
-	return byte(constant)
+	p.emitByte(byte(OP_RETURN))
 }
 
-func currentChunk() *Chunk {
-	return compilingChunk
+func (p *Parser) emitByte(b byte) {
+	p.emitByteAt(&p.previous, b)
 }
 
-func errorAtCurrent(msg string) {
-	errorAt(&parser.current, msg)
+func (p *Parser) emitBytes(b1 byte, b2 byte) {
+	p.emitBytesAt(&p.previous, b1, b2)
 }
 
-func errorAtPrevious(msg string) {
-	errorAt(&parser.previous, msg)
+// emitByteAt attributes b to token rather than to the last token consumed,
+// so an operator's instruction points at the operator instead of at the end
+// of its right operand.
+func (p *Parser) emitByteAt(token *Token, b byte) {
+	p.currentChunk().write(b, token.line, token.column)
 }
 
-func errorAt(token *Token, msg string) {
-	if parser.hadError {
-		return
+func (p *Parser) emitBytesAt(token *Token, b1 byte, b2 byte) {
+	p.emitByteAt(token, b1)
+	p.emitByteAt(token, b2)
+}
+
+func (p *Parser) makeConstant(value Value) int {
+	if constant, ok := p.compiler.findConstant(value); ok {
+		return constant
 	}
-	parser.panicMode = true
 
-	fmt.Fprintf(os.Stderr, "[line %d] Error", token.line)
-	if token.tokenType == TOKEN_EOF {
-		fmt.Fprintf(os.Stderr, " at end")
-	} else if token.tokenType == TOKEN_ERROR {
+	constant := p.currentChunk().addConstant(value)
+	if constant > MAX_LONG_OPERAND {
+		p.errorAtPrevious("Too many constants in one chunk.")
+		return 0
+	}
 
-	} else {
-		fmt.Fprintf(os.Stderr, " at '%.*s'", len(token.lexeme), token.lexeme)
+	p.compiler.rememberConstant(value, constant)
+	return constant
+}
+
+func (c *Compiler) findConstant(value Value) (int, bool) {
+	var constant int
+	var ok bool
+	if value.isString() {
+		constant, ok = c.stringConstants[value.asString()]
+	} else if value.isType(VAL_NUMBER) {
+		// Compare bit patterns so that 0 and -0 stay distinct.
+		constant, ok = c.numberConstants[math.Float64bits(value.asNumber())]
 	}
+	return constant, ok
+}
 
-	fmt.Fprintf(os.Stderr, ": %s\n", msg)
+func (c *Compiler) rememberConstant(value Value, constant int) {
+	if value.isString() {
+		c.stringConstants[value.asString()] = constant
+	} else if value.isType(VAL_NUMBER) {
+		c.numberConstants[math.Float64bits(value.asNumber())] = constant
+	}
+}
+
+func (p *Parser) currentChunk() *Chunk {
+	return &p.compiler.function.chunk
+}
+
+func (p *Parser) errorAtCurrent(msg string) {
+	p.errorAt(&p.current, msg)
+}
+
+func (p *Parser) errorAtPrevious(msg string) {
+	p.errorAt(&p.previous, msg)
+}
 
-	parser.hadError = true
+// errorAt records an error unless the parser is already panicking, in which
+// case it is most likely a cascade from the first one and is dropped until
+// synchronize resets panicMode.
+func (p *Parser) errorAt(token *Token, msg string) {
+	if p.panicMode {
+		return
+	}
+	p.panicMode = true
+	p.hadError = true
+
+	// Synchronizing can't get past the end of the file, so every block left
+	// open there would report the same missing '}' again.
+	d := newDiagnostic(token, msg)
+	if n := len(p.diagnostics); n > 0 && p.diagnostics[n-1] == d {
+		return
+	}
+	p.diagnostics = append(p.diagnostics, d)
 }
 
 func init() {
 	rules = map[TokenType]ParseRule{
-		TOKEN_LEFT_PAREN:    {grouping, nil, PREC_NONE},
+		TOKEN_LEFT_PAREN:    {(*Parser).grouping, (*Parser).call, PREC_CALL},
 		TOKEN_RIGHT_PAREN:   {nil, nil, PREC_NONE},
 		TOKEN_LEFT_BRACE:    {nil, nil, PREC_NONE},
 		TOKEN_RIGHT_BRACE:   {nil, nil, PREC_NONE},
 		TOKEN_COMMA:         {nil, nil, PREC_NONE},
-		TOKEN_DOT:           {nil, nil, PREC_NONE},
-		TOKEN_MINUS:         {unary, binary, PREC_TERM},
-		TOKEN_PLUS:          {nil, binary, PREC_TERM},
+		TOKEN_DOT:           {nil, (*Parser).dot, PREC_CALL},
+		TOKEN_MINUS:         {(*Parser).unary, (*Parser).binary, PREC_TERM},
+		TOKEN_PLUS:          {nil, (*Parser).binary, PREC_TERM},
 		TOKEN_SEMICOLON:     {nil, nil, PREC_NONE},
-		TOKEN_SLASH:         {nil, binary, PREC_FACTOR},
-		TOKEN_STAR:          {nil, binary, PREC_FACTOR},
-		TOKEN_BANG:          {unary, nil, PREC_NONE},
-		TOKEN_BANG_EQUAL:    {nil, binary, PREC_EQUALITY},
+		TOKEN_SLASH:         {nil, (*Parser).binary, PREC_FACTOR},
+		TOKEN_STAR:          {nil, (*Parser).binary, PREC_FACTOR},
+		TOKEN_BANG:          {(*Parser).unary, nil, PREC_NONE},
+		TOKEN_BANG_EQUAL:    {nil, (*Parser).binary, PREC_EQUALITY},
 		TOKEN_EQUAL:         {nil, nil, PREC_NONE},
-		TOKEN_EQUAL_EQUAL:   {nil, binary, PREC_EQUALITY},
-		TOKEN_GREATER:       {nil, binary, PREC_COMPARISON},
-		TOKEN_GREATER_EQUAL: {nil, binary, PREC_COMPARISON},
-		TOKEN_LESS:          {nil, binary, PREC_COMPARISON},
-		TOKEN_LESS_EQUAL:    {nil, binary, PREC_COMPARISON},
-		TOKEN_IDENTIFIER:    {variable, nil, PREC_NONE},
-		TOKEN_STRING:        {gstring, nil, PREC_NONE},
-		TOKEN_NUMBER:        {number, nil, PREC_NONE},
-		TOKEN_AND:           {nil, nil, PREC_NONE},
+		TOKEN_EQUAL_EQUAL:   {nil, (*Parser).binary, PREC_EQUALITY},
+		TOKEN_GREATER:       {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_GREATER_EQUAL: {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_LESS:          {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_LESS_EQUAL:    {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_IDENTIFIER:    {(*Parser).variable, nil, PREC_NONE},
+		TOKEN_STRING:        {(*Parser).gstring, nil, PREC_NONE},
+		TOKEN_NUMBER:        {(*Parser).number, nil, PREC_NONE},
+		TOKEN_AND:           {nil, (*Parser).and_, PREC_AND},
+		TOKEN_BREAK:         {nil, nil, PREC_NONE},
 		TOKEN_CLASS:         {nil, nil, PREC_NONE},
+		TOKEN_CONTINUE:      {nil, nil, PREC_NONE},
 		TOKEN_ELSE:          {nil, nil, PREC_NONE},
-		TOKEN_FALSE:         {literal, nil, PREC_NONE},
+		TOKEN_FALSE:         {(*Parser).literal, nil, PREC_NONE},
 		TOKEN_FOR:           {nil, nil, PREC_NONE},
 		TOKEN_FUN:           {nil, nil, PREC_NONE},
 		TOKEN_IF:            {nil, nil, PREC_NONE},
-		TOKEN_NIL:           {literal, nil, PREC_NONE},
-		TOKEN_OR:            {nil, nil, PREC_NONE},
+		TOKEN_NIL:           {(*Parser).literal, nil, PREC_NONE},
+		TOKEN_OR:            {nil, (*Parser).or_, PREC_OR},
 		TOKEN_PRINT:         {nil, nil, PREC_NONE},
 		TOKEN_RETURN:        {nil, nil, PREC_NONE},
-		TOKEN_SUPER:         {nil, nil, PREC_NONE},
-		TOKEN_THIS:          {nil, nil, PREC_NONE},
-		TOKEN_TRUE:          {literal, nil, PREC_NONE},
+		TOKEN_SUPER:         {(*Parser).super_, nil, PREC_NONE},
+		TOKEN_THIS:          {(*Parser).this_, nil, PREC_NONE},
+		TOKEN_TRUE:          {(*Parser).literal, nil, PREC_NONE},
 		TOKEN_VAR:           {nil, nil, PREC_NONE},
 		TOKEN_WHILE:         {nil, nil, PREC_NONE},
 		TOKEN_ERROR:         {nil, nil, PREC_NONE},
@@ -0,0 +1,153 @@
+package glox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func containsOp(chunk *Chunk, op OpCode) bool {
+	found := false
+	for offset := 0; offset < chunk.count; {
+		if OpCode(chunk.code[offset]) == op {
+			found = true
+		}
+		offset = disassembleInstruction(ioutil.Discard, chunk, offset)
+	}
+	return found
+}
+
+func TestWideOperands(t *testing.T) {
+	var source strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&source, "var g%d = %d.5;\n", i, i)
+	}
+	source.WriteString("g299 = g298 + g0;\nprint g299;\n")
+	source.WriteString("fun locals() {\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&source, "var l%d = %d;\n", i, i)
+	}
+	source.WriteString("l299 = l298 + l1;\nreturn l299;\n}\nprint locals();\n")
+	source.WriteString(`
+class Base { describe() { return "base"; } }
+class Derived < Base {
+	init() { this.field = "?"; }
+	describe() { return super.describe() + this.field; }
+	getSuper() { return super.describe; }
+}
+var derived = Derived();
+derived.field = "!";
+print derived.describe();
+print derived.getSuper()();
+`)
+
+	vm := new(VM)
+	vm.Init()
+	function, _ := vm.compile(source.String())
+	if function == nil {
+		t.Fatalf("Compile failed with more than 256 constants and locals")
+	}
+
+	chunk := &function.chunk
+	for _, op := range []OpCode{OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG, OP_SET_GLOBAL_LONG,
+		OP_CLOSURE_LONG, OP_CLASS_LONG, OP_METHOD_LONG, OP_SET_PROPERTY_LONG, OP_INVOKE_LONG} {
+		if !containsOp(chunk, op) {
+			t.Errorf("Expected the script to use opcode %d", op)
+		}
+	}
+	var locals *ObjFunction
+	for _, constant := range chunk.constants.values {
+		if constant.isFunction() && constant.asFunction().name.str == "locals" {
+			locals = constant.asFunction()
+		}
+	}
+	for _, op := range []OpCode{OP_GET_LOCAL_LONG, OP_SET_LOCAL_LONG} {
+		if !containsOp(&locals.chunk, op) {
+			t.Errorf("Expected locals() to use opcode %d", op)
+		}
+	}
+
+	result := vm.interpret(source.String())
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed with more than 256 constants and locals")
+	}
+	value, _ := vm.globals.tableGet(vm.allocateString("g299"))
+	if value.asNumber() != 298.5+0.5 {
+		t.Errorf("Expected g299 to be 299, got %g", value.asNumber())
+	}
+	vm.Free()
+}
+
+func TestWideUpvalues(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("fun outer() {\n")
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&source, "var l%d = %d;\n", i, i)
+	}
+	source.WriteString(`
+	fun middle() {
+		fun inner() { l299 = l299 + l1; return l299; }
+		return inner;
+	}
+	return middle();
+}
+var inner = outer();
+print inner();
+print inner();
+`)
+
+	var out, disassembly bytes.Buffer
+	vm := new(VM)
+	vm.Init()
+	vm.Options.Stdout = &out
+	vm.Options.Disassemble = true
+	vm.Options.DebugOutput = &disassembly
+	if result := vm.interpret(source.String()); result != INTERPRET_OK {
+		t.Fatalf("Capturing a local past slot 255 failed: %v", result)
+	}
+	if out.String() != "300\n301\n" {
+		t.Errorf("Expected 300 and 301, got %q", out.String())
+	}
+	if !strings.Contains(disassembly.String(), "local 300") {
+		t.Errorf("Expected middle() to capture l299 from slot 300:\n%s", disassembly.String())
+	}
+	vm.Free()
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("var counter = 0;\n")
+	for i := 0; i < 300; i++ {
+		source.WriteString("counter = counter + 1.5;\n")
+	}
+	source.WriteString("print \"done\"; print \"done\";\n")
+	source.WriteString("print 0; print -0; print 0;\n")
+
+	vm := new(VM)
+	vm.Init()
+	function, _ := vm.compile(source.String())
+	if function == nil {
+		t.Fatalf("Compile failed when referencing one global 300 times")
+	}
+
+	counts := map[string]int{}
+	for _, constant := range function.chunk.constants.values {
+		switch {
+		case constant.isString():
+			counts[constant.asString().str]++
+		case constant.isType(VAL_NUMBER):
+			counts[fmt.Sprint(constant.asNumber())]++
+		}
+	}
+	for _, name := range []string{"counter", "done", "1.5", "0"} {
+		if counts[name] != 1 {
+			t.Errorf("Expected a single pool entry for %s, found %d", name, counts[name])
+		}
+	}
+	if function.chunk.constants.count != 4 {
+		t.Errorf("Expected 4 constants, found %d", function.chunk.constants.count)
+	}
+	vm.Free()
+}
@@ -1,87 +1,221 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
-func disassemble(c *Chunk, name string) {
-	fmt.Printf("== %s ==\n", name)
+func disassemble(w io.Writer, c *Chunk, name string) {
+	fmt.Fprintf(w, "== %s ==\n", name)
 	for offset := 0; offset < c.count; {
-		offset = disassembleInstruction(c, offset)
+		offset = disassembleInstruction(w, c, offset)
 	}
 }
 
-func disassembleInstruction(c *Chunk, offset int) int {
-	fmt.Printf("%04d ", offset)
-	if offset > 0 && c.lines[offset] == c.lines[offset-1] {
-		fmt.Print("   | ")
+func disassembleInstruction(w io.Writer, c *Chunk, offset int) int {
+	fmt.Fprintf(w, "%04d ", offset)
+	position := c.positionAt(offset)
+	if offset > 0 && position == c.positionAt(offset-1) {
+		fmt.Fprint(w, "     |   ")
 	} else {
-		fmt.Printf("%4d ", c.lines[offset])
+		fmt.Fprintf(w, "%4d:%-3d ", position.line, position.column)
 	}
 
 	instruction := c.code[offset]
 	switch OpCode(instruction) {
 	case OP_CONSTANT:
-		return constantInstruction("OP_CONSTANT", c, offset)
+		return constantInstruction(w, "OP_CONSTANT", c, offset)
+	case OP_CONSTANT_LONG:
+		return constantLongInstruction(w, "OP_CONSTANT_LONG", c, offset)
 	case OP_NIL:
-		return simpleInstruction("OP_NIL", offset)
+		return simpleInstruction(w, "OP_NIL", offset)
 	case OP_TRUE:
-		return simpleInstruction("OP_TRUE", offset)
+		return simpleInstruction(w, "OP_TRUE", offset)
 	case OP_FALSE:
-		return simpleInstruction("OP_FALSE", offset)
+		return simpleInstruction(w, "OP_FALSE", offset)
 	case OP_POP:
-		return simpleInstruction("OP_POP", offset)
+		return simpleInstruction(w, "OP_POP", offset)
 	case OP_GET_LOCAL:
-		return byteInstruction("OP_GET_LOCAL", c, offset)
+		return byteInstruction(w, "OP_GET_LOCAL", c, offset)
+	case OP_GET_LOCAL_LONG:
+		return longInstruction(w, "OP_GET_LOCAL_LONG", c, offset)
 	case OP_SET_LOCAL:
-		return byteInstruction("OP_SET_LOCAL", c, offset)
+		return byteInstruction(w, "OP_SET_LOCAL", c, offset)
+	case OP_SET_LOCAL_LONG:
+		return longInstruction(w, "OP_SET_LOCAL_LONG", c, offset)
 	case OP_GET_GLOBAL:
-		return constantInstruction("OP_GET_GLOBAL", c, offset)
+		return constantInstruction(w, "OP_GET_GLOBAL", c, offset)
+	case OP_GET_GLOBAL_LONG:
+		return constantLongInstruction(w, "OP_GET_GLOBAL_LONG", c, offset)
 	case OP_DEFINE_GLOBAL:
-		return constantInstruction("OP_DEFINE_GLOBAL", c, offset)
+		return constantInstruction(w, "OP_DEFINE_GLOBAL", c, offset)
+	case OP_DEFINE_GLOBAL_LONG:
+		return constantLongInstruction(w, "OP_DEFINE_GLOBAL_LONG", c, offset)
 	case OP_SET_GLOBAL:
-		return constantInstruction("OP_SET_GLOBAL", c, offset)
+		return constantInstruction(w, "OP_SET_GLOBAL", c, offset)
+	case OP_SET_GLOBAL_LONG:
+		return constantLongInstruction(w, "OP_SET_GLOBAL_LONG", c, offset)
+	case OP_GET_UPVALUE:
+		return byteInstruction(w, "OP_GET_UPVALUE", c, offset)
+	case OP_SET_UPVALUE:
+		return byteInstruction(w, "OP_SET_UPVALUE", c, offset)
+	case OP_GET_PROPERTY:
+		return constantInstruction(w, "OP_GET_PROPERTY", c, offset)
+	case OP_GET_PROPERTY_LONG:
+		return constantLongInstruction(w, "OP_GET_PROPERTY_LONG", c, offset)
+	case OP_SET_PROPERTY:
+		return constantInstruction(w, "OP_SET_PROPERTY", c, offset)
+	case OP_SET_PROPERTY_LONG:
+		return constantLongInstruction(w, "OP_SET_PROPERTY_LONG", c, offset)
+	case OP_GET_SUPER:
+		return constantInstruction(w, "OP_GET_SUPER", c, offset)
+	case OP_GET_SUPER_LONG:
+		return constantLongInstruction(w, "OP_GET_SUPER_LONG", c, offset)
 	case OP_EQUAL:
-		return simpleInstruction("OP_EQUAL", offset)
+		return simpleInstruction(w, "OP_EQUAL", offset)
 	case OP_GREATER:
-		return simpleInstruction("OP_GREATER", offset)
+		return simpleInstruction(w, "OP_GREATER", offset)
 	case OP_LESS:
-		return simpleInstruction("OP_LESS", offset)
+		return simpleInstruction(w, "OP_LESS", offset)
 	case OP_ADD:
-		return simpleInstruction("OP_ADD", offset)
+		return simpleInstruction(w, "OP_ADD", offset)
 	case OP_SUBSTRACT:
-		return simpleInstruction("OP_SUBSTRACT", offset)
+		return simpleInstruction(w, "OP_SUBSTRACT", offset)
 	case OP_MULTIPLY:
-		return simpleInstruction("OP_MULTIPLY", offset)
+		return simpleInstruction(w, "OP_MULTIPLY", offset)
 	case OP_DIVIDE:
-		return simpleInstruction("OP_DIVIDE", offset)
+		return simpleInstruction(w, "OP_DIVIDE", offset)
 	case OP_NOT:
-		return simpleInstruction("OP_NOT", offset)
+		return simpleInstruction(w, "OP_NOT", offset)
 	case OP_NEGATE:
-		return simpleInstruction("OP_NEGATE", offset)
+		return simpleInstruction(w, "OP_NEGATE", offset)
 	case OP_PRINT:
-		return simpleInstruction("OP_PRINT", offset)
+		return simpleInstruction(w, "OP_PRINT", offset)
+	case OP_JUMP:
+		return jumpInstruction(w, "OP_JUMP", 1, c, offset)
+	case OP_JUMP_IF_FALSE:
+		return jumpInstruction(w, "OP_JUMP_IF_FALSE", 1, c, offset)
+	case OP_LOOP:
+		return jumpInstruction(w, "OP_LOOP", -1, c, offset)
+	case OP_CALL:
+		return byteInstruction(w, "OP_CALL", c, offset)
+	case OP_INVOKE:
+		return invokeInstruction(w, "OP_INVOKE", c, offset)
+	case OP_INVOKE_LONG:
+		return invokeLongInstruction(w, "OP_INVOKE_LONG", c, offset)
+	case OP_SUPER_INVOKE:
+		return invokeInstruction(w, "OP_SUPER_INVOKE", c, offset)
+	case OP_SUPER_INVOKE_LONG:
+		return invokeLongInstruction(w, "OP_SUPER_INVOKE_LONG", c, offset)
+	case OP_CLOSURE:
+		return closureInstruction(w, "OP_CLOSURE", c, offset+2, int(c.code[offset+1]))
+	case OP_CLOSURE_LONG:
+		return closureInstruction(w, "OP_CLOSURE_LONG", c, offset+4, readLong(c, offset+1))
+	case OP_CLOSE_UPVALUE:
+		return simpleInstruction(w, "OP_CLOSE_UPVALUE", offset)
 	case OP_RETURN:
-		return simpleInstruction("OP_RETURN", offset)
+		return simpleInstruction(w, "OP_RETURN", offset)
+	case OP_CLASS:
+		return constantInstruction(w, "OP_CLASS", c, offset)
+	case OP_CLASS_LONG:
+		return constantLongInstruction(w, "OP_CLASS_LONG", c, offset)
+	case OP_INHERIT:
+		return simpleInstruction(w, "OP_INHERIT", offset)
+	case OP_METHOD:
+		return constantInstruction(w, "OP_METHOD", c, offset)
+	case OP_METHOD_LONG:
+		return constantLongInstruction(w, "OP_METHOD_LONG", c, offset)
 	default:
-		fmt.Printf("Unknown opcode %d\n", instruction)
+		fmt.Fprintf(w, "Unknown opcode %d\n", instruction)
 		return offset + 1
 	}
 }
 
-func simpleInstruction(name string, offset int) int {
-	fmt.Printf("%s\n", name)
+func simpleInstruction(w io.Writer, name string, offset int) int {
+	fmt.Fprintf(w, "%s\n", name)
 	return offset + 1
 }
 
-func constantInstruction(name string, chunk *Chunk, offset int) int {
+func constantInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
 	constant := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d '", name, constant)
-	printValue(chunk.constants.values[constant])
-	fmt.Println("'")
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	fmt.Fprint(w, chunk.constants.values[constant])
+	fmt.Fprintln(w, "'")
 	return offset + 2
 }
 
-func byteInstruction(name string, chunk *Chunk, offset int) int {
+func readLong(chunk *Chunk, offset int) int {
+	return int(chunk.code[offset])<<16 | int(chunk.code[offset+1])<<8 | int(chunk.code[offset+2])
+}
+
+func constantLongInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	constant := readLong(chunk, offset+1)
+	fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	fmt.Fprint(w, chunk.constants.values[constant])
+	fmt.Fprintln(w, "'")
+	return offset + 4
+}
+
+func longInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	slot := readLong(chunk, offset+1)
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
+	return offset + 4
+}
+
+func invokeInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	constant := chunk.code[offset+1]
+	argCount := chunk.code[offset+2]
+	fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	fmt.Fprint(w, chunk.constants.values[constant])
+	fmt.Fprintln(w, "'")
+	return offset + 3
+}
+
+func invokeLongInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
+	constant := readLong(chunk, offset+1)
+	argCount := chunk.code[offset+4]
+	fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	fmt.Fprint(w, chunk.constants.values[constant])
+	fmt.Fprintln(w, "'")
+	return offset + 5
+}
+
+// closureInstruction prints a closure whose constant operand has already
+// been decoded, followed by one line per captured variable.
+func closureInstruction(w io.Writer, name string, chunk *Chunk, offset int, constant int) int {
+	fmt.Fprintf(w, "%-16s %4d ", name, constant)
+	fmt.Fprint(w, chunk.constants.values[constant])
+	fmt.Fprintln(w)
+
+	function := chunk.constants.values[constant].asFunction()
+	for j := 0; j < function.upvalueCount; j++ {
+		start := offset
+		flags := chunk.code[offset]
+		var index int
+		if flags&UPVALUE_LONG != 0 {
+			index = readLong(chunk, offset+1)
+			offset += 4
+		} else {
+			index = int(chunk.code[offset+1])
+			offset += 2
+		}
+		kind := "upvalue"
+		if flags&UPVALUE_LOCAL != 0 {
+			kind = "local"
+		}
+		fmt.Fprintf(w, "%04d      |                     %s %d\n", start, kind, index)
+	}
+	return offset
+}
+
+func byteInstruction(w io.Writer, name string, chunk *Chunk, offset int) int {
 	slot := chunk.code[offset+1]
-	fmt.Printf("%-16s %4d\n", name, slot)
+	fmt.Fprintf(w, "%-16s %4d\n", name, slot)
 	return offset + 2
 }
+
+func jumpInstruction(w io.Writer, name string, sign int, chunk *Chunk, offset int) int {
+	jump := int(chunk.code[offset+1])<<8 | int(chunk.code[offset+2])
+	fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, offset+3+sign*jump)
+	return offset + 3
+}
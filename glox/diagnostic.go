@@ -0,0 +1,127 @@
+package glox
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	ANSI_RESET    = "\x1b[0m"
+	ANSI_BOLD_RED = "\x1b[1;31m"
+	ANSI_BOLD     = "\x1b[1m"
+)
+
+// Diagnostic is a single compile error, positioned at the span of the token
+// that caused it.
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Length  int
+	Message string
+
+	where string
+}
+
+func newDiagnostic(token *Token, msg string) Diagnostic {
+	d := Diagnostic{
+		Line:    token.line,
+		Column:  token.column,
+		Length:  len(token.lexeme),
+		Message: msg,
+	}
+	switch token.tokenType {
+	case TOKEN_EOF:
+		d.where = " at end"
+		d.Length = 1
+	case TOKEN_ERROR:
+		// The lexeme of an error token is the message, not source text.
+		d.Length = 1
+	default:
+		d.where = fmt.Sprintf(" at '%s'", token.lexeme)
+	}
+	return d
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("[line %d:%d] Error%s: %s", d.Line, d.Column, d.where, d.Message)
+}
+
+// render writes the diagnostic followed by the offending source line with
+// the token span underlined.
+func (d Diagnostic) render(w io.Writer, source string, color bool) {
+	bold, red, reset := "", "", ""
+	if color {
+		bold, red, reset = ANSI_BOLD, ANSI_BOLD_RED, ANSI_RESET
+	}
+
+	fmt.Fprintf(w, "%s[line %d:%d] %sError%s%s%s: %s%s\n",
+		bold, d.Line, d.Column, red, reset, bold, d.where, d.Message, reset)
+
+	text, ok := sourceLine(source, d.Line)
+	if !ok {
+		return
+	}
+	gutter := fmt.Sprintf("%5d | ", d.Line)
+	fmt.Fprintf(w, "%s%s\n", gutter, text)
+
+	// Reuse the line's own tabs so the caret lines up however they render.
+	var indent strings.Builder
+	for i := 0; i < d.Column-1 && i < len(text); i++ {
+		if text[i] == '\t' {
+			indent.WriteByte('\t')
+		} else {
+			indent.WriteByte(' ')
+		}
+	}
+	// A token spanning several lines is only underlined up to the line end.
+	length := d.Length
+	if rest := len(text) - (d.Column - 1); length > rest {
+		length = rest
+	}
+	if length < 1 {
+		length = 1
+	}
+	fmt.Fprintf(w, "%*s | %s%s%s%s%s\n", len(gutter)-3, "",
+		indent.String(), red, "^", strings.Repeat("~", length-1), reset)
+}
+
+// sourceLine returns the 1-based line of source without its line ending.
+func sourceLine(source string, line int) (string, bool) {
+	for i := 1; i < line; i++ {
+		newline := strings.IndexByte(source, '\n')
+		if newline < 0 {
+			return "", false
+		}
+		source = source[newline+1:]
+	}
+	if newline := strings.IndexByte(source, '\n'); newline >= 0 {
+		source = source[:newline]
+	}
+	return strings.TrimSuffix(source, "\r"), true
+}
+
+func renderDiagnostics(w io.Writer, source string, diagnostics []Diagnostic) {
+	color := isTerminal(w)
+	for _, d := range diagnostics {
+		d.render(w, source, color)
+	}
+}
+
+// isTerminal reports whether w is a character device, honouring the
+// NO_COLOR convention.
+func isTerminal(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
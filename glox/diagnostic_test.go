@@ -0,0 +1,64 @@
+package glox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollectDiagnostics(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := "var a = ;\nprint a\nprint 1 +;\n"
+	function, diagnostics := vm.compile(source)
+	if function != nil {
+		t.Fatalf("Expected compile errors: %s", source)
+	}
+
+	expected := []string{
+		"[line 1:9] Error at ';': Expect expression.",
+		"[line 3:1] Error at 'print': Expect ';' after value.",
+		"[line 3:10] Error at ';': Expect expression.",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, found %v", len(expected), diagnostics)
+	}
+	for i, want := range expected {
+		if got := diagnostics[i].Error(); got != want {
+			t.Errorf("Diagnostic %d = %q, want %q", i, got, want)
+		}
+	}
+	vm.Free()
+}
+
+func TestUnclosedBlocksAtEnd(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	_, diagnostics := vm.compile("fun f() {\n if (true) {\n print 1;\n")
+
+	expected := "[line 4:1] Error at end: Expect '}' after block."
+	if len(diagnostics) != 1 || diagnostics[0].Error() != expected {
+		t.Errorf("Expected only %q, found %v", expected, diagnostics)
+	}
+	vm.Free()
+}
+
+func TestRenderDiagnostic(t *testing.T) {
+	source := "var a = 1;\n\tprint a +* 2;\n"
+	d := Diagnostic{Line: 2, Column: 11, Length: 1, Message: "Expect expression.", where: " at '*'"}
+
+	var out strings.Builder
+	d.render(&out, source, false)
+	want := "[line 2:11] Error at '*': Expect expression.\n" +
+		"    2 | \tprint a +* 2;\n" +
+		"      | \t         ^\n"
+	if out.String() != want {
+		t.Errorf("Rendered\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	d = Diagnostic{Line: 1, Column: 5, Length: 3, Message: "Oops.", where: " at 'a'"}
+	d.render(&out, source, true)
+	if !strings.Contains(out.String(), ANSI_BOLD_RED+"^~~"+ANSI_RESET) {
+		t.Errorf("Expected a colored underline, got %q", out.String())
+	}
+}
@@ -0,0 +1,100 @@
+package glox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Errors wrapped by a RuntimeError when the script hits one of the limits
+// set in Options. A script stopped through its context wraps the context's
+// error instead.
+var (
+	ErrStackOverflow    = errors.New("stack overflow")
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrHeapLimit        = errors.New("heap limit exceeded")
+)
+
+// ReportError writes err to w: compile errors with their source snippets,
+// runtime errors with their stack trace, and anything else by its message.
+// A nil error writes nothing.
+func ReportError(w io.Writer, err error) {
+	switch err := err.(type) {
+	case nil:
+	case *CompileError:
+		err.Render(w)
+	case *RuntimeError:
+		fmt.Fprint(w, err.StackTrace())
+	default:
+		fmt.Fprintln(w, err)
+	}
+}
+
+// StackFrame is one active call at the point a runtime error was raised.
+// Function is "script" for top-level code.
+type StackFrame struct {
+	Function string
+	Line     int
+	Column   int
+}
+
+func (f StackFrame) String() string {
+	if f.Function == "script" {
+		return fmt.Sprintf("[line %d:%d] in script", f.Line, f.Column)
+	}
+	return fmt.Sprintf("[line %d:%d] in %s()", f.Line, f.Column, f.Function)
+}
+
+// CompileError is returned when a script fails to compile. It carries every
+// error found, in source order.
+type CompileError struct {
+	Script      string
+	Source      string
+	Diagnostics []Diagnostic
+}
+
+func (e *CompileError) Error() string {
+	messages := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		messages[i] = d.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Render writes each diagnostic with its source line and a caret under the
+// offending token, colored when w is a terminal.
+func (e *CompileError) Render(w io.Writer) {
+	renderDiagnostics(w, e.Source, e.Diagnostics)
+}
+
+// RuntimeError describes an error raised while running a script, along with
+// the call stack at that point, innermost frame first.
+type RuntimeError struct {
+	Script  string
+	Message string
+	Frames  []StackFrame
+	// Cause is set when the script was stopped by a limit or its context
+	// rather than by an error in the script itself.
+	Cause error
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Cause
+}
+
+// StackTrace renders the message followed by one line per frame.
+func (e *RuntimeError) StackTrace() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	b.WriteByte('\n')
+	for _, frame := range e.Frames {
+		b.WriteString(frame.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
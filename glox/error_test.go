@@ -0,0 +1,61 @@
+package glox
+
+import "testing"
+
+func TestRuntimeStackTrace(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `fun inner(x) {
+  return x - nil;
+}
+fun outer() {
+  return inner(1);
+}
+outer();
+`
+	if result := vm.interpret(source); result != INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("Expected runtime error: %s", source)
+	}
+
+	err := vm.lastError
+	if err == nil {
+		t.Fatalf("Expected a RuntimeError to be recorded")
+	}
+	if err.Message != "Operands must be numbers." {
+		t.Errorf("Unexpected message %q", err.Message)
+	}
+	expected := []StackFrame{
+		{"inner", 2, 12},
+		{"outer", 5, 15},
+		{"script", 7, 6},
+	}
+	if len(err.Frames) != len(expected) {
+		t.Fatalf("Expected %d frames, found %v", len(expected), err.Frames)
+	}
+	for i, want := range expected {
+		if err.Frames[i] != want {
+			t.Errorf("Frame %d = %v, want %v", i, err.Frames[i], want)
+		}
+	}
+
+	want := "Operands must be numbers.\n" +
+		"[line 2:12] in inner()\n" +
+		"[line 5:15] in outer()\n" +
+		"[line 7:6] in script\n"
+	if err.StackTrace() != want {
+		t.Errorf("StackTrace() = %q, want %q", err.StackTrace(), want)
+	}
+	vm.Free()
+}
+
+func TestRuntimeErrorFormatting(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	if result := vm.interpret("print undefinedName;"); result != INTERPRET_RUNTIME_ERROR {
+		t.Fatalf("Expected runtime error")
+	}
+	if got := vm.lastError.Error(); got != "Undefined variable 'undefinedName'." {
+		t.Errorf("Unexpected message %q", got)
+	}
+	vm.Free()
+}
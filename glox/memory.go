@@ -0,0 +1,211 @@
+package glox
+
+import "fmt"
+
+const GC_HEAP_GROW_FACTOR = 2
+const GC_INITIAL_THRESHOLD = 1024 * 1024
+
+// allocateObject accounts for a freshly created object and links it into
+// vm.objects. A collection may run first, so everything the new object
+// refers to must already be reachable from the roots.
+func (vm *VM) allocateObject(obj IObj, size int) {
+	vm.bytesAllocated += size
+	if vm.Options.StressGC || vm.bytesAllocated > vm.nextGC || vm.overHeapLimit() {
+		vm.collectGarbage()
+	}
+
+	header := obj.header()
+	header.size = size
+	header.nextObj = vm.objects
+	vm.objects = obj
+
+	if vm.Options.TraceGC {
+		fmt.Fprintf(vm.Options.debugOutput(), "%p allocate %d for %d\n", obj, size, obj.ObjType())
+	}
+}
+
+func (vm *VM) overHeapLimit() bool {
+	return vm.Options.MaxHeapBytes > 0 && vm.bytesAllocated > vm.Options.MaxHeapBytes
+}
+
+func (vm *VM) collectGarbage() {
+	var before int
+	if vm.Options.TraceGC {
+		fmt.Fprintln(vm.Options.debugOutput(), "-- gc begin")
+		before = vm.bytesAllocated
+	}
+
+	vm.markRoots()
+	vm.traceReferences()
+	vm.strings.tableRemoveWhite()
+	vm.sweep()
+
+	vm.nextGC = vm.bytesAllocated * GC_HEAP_GROW_FACTOR
+	if vm.nextGC < GC_INITIAL_THRESHOLD {
+		vm.nextGC = GC_INITIAL_THRESHOLD
+	}
+
+	if vm.Options.TraceGC {
+		fmt.Fprintln(vm.Options.debugOutput(), "-- gc end")
+		fmt.Fprintf(vm.Options.debugOutput(), "   collected %d bytes (from %d to %d) next at %d\n",
+			before-vm.bytesAllocated, before, vm.bytesAllocated, vm.nextGC)
+	}
+}
+
+func (vm *VM) markRoots() {
+	for slot := 0; slot < vm.stackTop; slot++ {
+		vm.markValue(vm.stack[slot])
+	}
+
+	for i := 0; i < vm.frameCount; i++ {
+		vm.markObject(vm.frames[i].closure)
+	}
+
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.nextUpvalue {
+		vm.markObject(upvalue)
+	}
+
+	vm.markValue(vm.result)
+	for _, value := range vm.nativeValues {
+		vm.markValue(value)
+	}
+	vm.markTable(&vm.globals)
+	vm.markCompilerRoots()
+	if vm.initString != nil {
+		vm.markObject(vm.initString)
+	}
+}
+
+func (vm *VM) markCompilerRoots() {
+	if vm.parser == nil {
+		return
+	}
+	for compiler := vm.parser.compiler; compiler != nil; compiler = compiler.enclosing {
+		vm.markObject(compiler.function)
+	}
+}
+
+func (vm *VM) markValue(value Value) {
+	if value.isType(VAL_OBJ) {
+		vm.markObject(value.asObj())
+	}
+}
+
+func (vm *VM) markObject(obj IObj) {
+	header := obj.header()
+	if header.isMarked {
+		return
+	}
+
+	if vm.Options.TraceGC {
+		fmt.Fprintf(vm.Options.debugOutput(), "%p mark %v\n", obj, OBJ_VAL(obj))
+	}
+
+	header.isMarked = true
+	vm.grayStack = append(vm.grayStack, obj)
+}
+
+func (vm *VM) markTable(table *Table) {
+	for i := range table.entries {
+		entry := &table.entries[i]
+		if entry.key != nil {
+			vm.markObject(entry.key)
+		}
+		vm.markValue(entry.value)
+	}
+}
+
+func (vm *VM) markArray(array *ValueArray) {
+	for _, value := range array.values {
+		vm.markValue(value)
+	}
+}
+
+func (vm *VM) traceReferences() {
+	for len(vm.grayStack) > 0 {
+		obj := vm.grayStack[len(vm.grayStack)-1]
+		vm.grayStack = vm.grayStack[:len(vm.grayStack)-1]
+		vm.blackenObject(obj)
+	}
+}
+
+func (vm *VM) blackenObject(obj IObj) {
+	if vm.Options.TraceGC {
+		fmt.Fprintf(vm.Options.debugOutput(), "%p blacken %v\n", obj, OBJ_VAL(obj))
+	}
+
+	switch o := obj.(type) {
+	case *ObjBoundMethod:
+		vm.markValue(o.receiver)
+		vm.markObject(o.method)
+	case *ObjClass:
+		vm.markObject(o.name)
+		vm.markTable(&o.methods)
+	case *ObjClosure:
+		vm.markObject(o.function)
+		for _, upvalue := range o.upvalues {
+			// Upvalues are filled in after the closure is allocated.
+			if upvalue != nil {
+				vm.markObject(upvalue)
+			}
+		}
+	case *ObjFunction:
+		if o.name != nil {
+			vm.markObject(o.name)
+		}
+		vm.markArray(&o.chunk.constants)
+	case *ObjInstance:
+		vm.markObject(o.klass)
+		vm.markTable(&o.fields)
+	case *ObjUpvalue:
+		vm.markValue(o.closed)
+	case *ObjNative:
+	case *ObjString:
+	}
+}
+
+func (vm *VM) sweep() {
+	var previous IObj
+	object := vm.objects
+	for object != nil {
+		header := object.header()
+		if header.isMarked {
+			header.isMarked = false
+			previous = object
+			object = header.nextObj
+			continue
+		}
+
+		unreached := object
+		object = header.nextObj
+		if previous != nil {
+			previous.header().nextObj = object
+		} else {
+			vm.objects = object
+		}
+
+		vm.freeObject(unreached)
+	}
+}
+
+func (vm *VM) freeObject(obj IObj) {
+	if vm.Options.TraceGC {
+		fmt.Fprintf(vm.Options.debugOutput(), "%p free type %d\n", obj, obj.ObjType())
+	}
+
+	header := obj.header()
+	vm.bytesAllocated -= header.size
+	header.nextObj = nil
+	obj.free()
+}
+
+func (vm *VM) freeObjects() {
+	object := vm.objects
+	for object != nil {
+		next := object.next()
+		vm.freeObject(object)
+		object = next
+	}
+	vm.objects = nil
+	vm.grayStack = nil
+}
@@ -0,0 +1,78 @@
+package glox
+
+import "testing"
+
+func countObjects(vm *VM) int {
+	count := 0
+	for obj := vm.objects; obj != nil; obj = obj.next() {
+		count++
+	}
+	return count
+}
+
+func TestStressGC(t *testing.T) {
+	vm := new(VM)
+	vm.Options.StressGC = true
+	vm.Init()
+	source := `
+class Node {
+	init(value, next) {
+		this.value = value;
+		this.next = next;
+	}
+	sum() {
+		if (this.next == nil) return this.value;
+		return this.value + this.next.sum();
+	}
+}
+fun makeAdder(n) {
+	fun add(m) { return n + m; }
+	return add;
+}
+var list = nil;
+for (var i = 0; i < 20; i = i + 1) {
+	list = Node(makeAdder(i)(1), list);
+}
+print list.sum();
+print "interned" == "interned";
+`
+	result := vm.interpret(source)
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed: %s", source)
+	}
+	vm.Free()
+}
+
+func TestCollectGarbage(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+class Garbage {}
+for (var i = 0; i < 100; i = i + 1) {
+	var g = Garbage();
+	g.field = Garbage();
+}
+var kept = Garbage();
+`
+	result := vm.interpret(source)
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed: %s", source)
+	}
+
+	before := countObjects(vm)
+	vm.collectGarbage()
+	after := countObjects(vm)
+	if after >= before || before-after < 200 {
+		t.Errorf("Expected at least 200 objects to be collected, went from %d to %d", before, after)
+	}
+
+	result = vm.interpret("print kept;")
+	if result != INTERPRET_OK {
+		t.Errorf("Reachable global was collected")
+	}
+
+	vm.Free()
+	if vm.objects != nil || vm.bytesAllocated != 0 {
+		t.Errorf("Free left %d objects and %d bytes", countObjects(vm), vm.bytesAllocated)
+	}
+}
@@ -0,0 +1,29 @@
+package glox
+
+import "time"
+
+var startTime = time.Now()
+
+// DefineNative exposes fn to scripts as a global function called name.
+// Calls with a different number of arguments than arity are runtime errors.
+func (vm *VM) DefineNative(name string, arity int, fn NativeFn) {
+	vm.push(OBJ_VAL(vm.allocateString(name)))
+	vm.push(OBJ_VAL(vm.newNative(arity, fn)))
+	vm.globals.tableSet(vm.peek(1).asString(), vm.peek(0))
+	vm.pop()
+	vm.pop()
+}
+
+// String returns a Lox string holding s, for a native to return or to
+// pass back in its result. Strings made during a native call stay alive
+// until the call returns; after that, only those the script still refers
+// to are kept.
+func (vm *VM) String(s string) Value {
+	value := OBJ_VAL(vm.allocateString(s))
+	vm.nativeValues = append(vm.nativeValues, value)
+	return value
+}
+
+func clockNative(args []Value) (Value, error) {
+	return NUMBER_VAL(time.Since(startTime).Seconds()), nil
+}
@@ -0,0 +1,76 @@
+package glox
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDefineNative(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+
+	var received []float64
+	vm.DefineNative("record", 2, func(args []Value) (Value, error) {
+		received = []float64{args[0].AsNumber(), args[1].AsNumber()}
+		return NUMBER_VAL(args[0].asNumber() * args[1].asNumber()), nil
+	})
+	vm.DefineNative("fail", 0, func(args []Value) (Value, error) {
+		return NIL_VAL(), errors.New("native failure")
+	})
+
+	source := `
+var start = clock();
+print record(6, 7);
+print clock() >= start;
+print clock;
+`
+	result := vm.interpret(source)
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed: %s", source)
+	}
+	if len(received) != 2 || received[0] != 6 || received[1] != 7 {
+		t.Errorf("Native received wrong arguments: %v", received)
+	}
+
+	runtimeErrors := []string{
+		"fail();",
+		"record(1);",
+	}
+	for _, source := range runtimeErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_RUNTIME_ERROR {
+			t.Errorf("Expected runtime error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func TestNativeStrings(t *testing.T) {
+	var out strings.Builder
+	vm := new(VM)
+	// Collect before every allocation, so a string the VM stopped rooting
+	// would read back empty.
+	vm.Options.StressGC = true
+	vm.Options.Stdout = &out
+	vm.Init()
+
+	vm.DefineNative("greet", 1, func(args []Value) (Value, error) {
+		if !args[0].IsString() {
+			return NIL_VAL(), errors.New("Expected a name.")
+		}
+		greeting := vm.String("Hello, ")
+		name := vm.String(args[0].AsString() + "!")
+		return vm.String(greeting.AsString() + name.AsString()), nil
+	})
+
+	value, err := vm.Interpret(context.Background(), `var g = greet("na" + "tive"); print g; g + "";`, "strings")
+	if err != nil || !value.IsString() || value.AsString() != "Hello, native!" {
+		t.Errorf("Expected \"Hello, native!\", got %v (%v)", value, err)
+	}
+	if out.String() != "Hello, native!\n" {
+		t.Errorf("Printed %q", out.String())
+	}
+	vm.Free()
+}
@@ -1,17 +1,23 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"unsafe"
+)
 
 type IObj interface {
 	Hashable
 	ObjType() ObjType
+	header() *Obj
 	next() IObj
 	free()
 }
 
 type Obj struct {
-	nextObj IObj
-	hash    Hash
+	nextObj  IObj
+	hash     Hash
+	isMarked bool
+	size     int
 }
 
 type ObjString struct {
@@ -20,16 +26,112 @@ type ObjString struct {
 	str    string
 }
 
+type ObjFunction struct {
+	Obj
+	arity        int
+	upvalueCount int
+	chunk        Chunk
+	name         *ObjString
+}
+
+// NativeFn is a host function callable from Lox. A non-nil error aborts
+// the script with a runtime error carrying the error's message.
+//
+// Objects in args are only valid during the call: once the collector frees
+// one, a string reads back as "". Copy out what you need to keep, such as
+// the Go string from AsString, rather than keeping args. Use VM.String to
+// create strings.
+type NativeFn func(args []Value) (Value, error)
+
+type ObjNative struct {
+	Obj
+	arity    int
+	function NativeFn
+}
+
+type ObjUpvalue struct {
+	Obj
+	// location is the stack slot of the captured variable while the upvalue
+	// is open, and -1 once it has been closed over.
+	location    int
+	closed      Value
+	nextUpvalue *ObjUpvalue
+}
+
+type ObjClosure struct {
+	Obj
+	function     *ObjFunction
+	upvalues     []*ObjUpvalue
+	upvalueCount int
+}
+
+type ObjClass struct {
+	Obj
+	name    *ObjString
+	methods Table
+}
+
+type ObjBoundMethod struct {
+	Obj
+	receiver Value
+	method   *ObjClosure
+}
+
+type ObjInstance struct {
+	Obj
+	klass  *ObjClass
+	fields Table
+}
+
 type ObjType byte
 
 const (
-	OBJ_STRING ObjType = iota
+	OBJ_BOUND_METHOD ObjType = iota
+	OBJ_CLASS
+	OBJ_CLOSURE
+	OBJ_FUNCTION
+	OBJ_INSTANCE
+	OBJ_NATIVE
+	OBJ_STRING
+	OBJ_UPVALUE
 )
 
 func (os *ObjString) ObjType() ObjType {
 	return OBJ_STRING
 }
 
+func (of *ObjFunction) ObjType() ObjType {
+	return OBJ_FUNCTION
+}
+
+func (ob *ObjBoundMethod) ObjType() ObjType {
+	return OBJ_BOUND_METHOD
+}
+
+func (oc *ObjClass) ObjType() ObjType {
+	return OBJ_CLASS
+}
+
+func (oi *ObjInstance) ObjType() ObjType {
+	return OBJ_INSTANCE
+}
+
+func (on *ObjNative) ObjType() ObjType {
+	return OBJ_NATIVE
+}
+
+func (oc *ObjClosure) ObjType() ObjType {
+	return OBJ_CLOSURE
+}
+
+func (ou *ObjUpvalue) ObjType() ObjType {
+	return OBJ_UPVALUE
+}
+
+func (obj *Obj) header() *Obj {
+	return obj
+}
+
 func (obj *Obj) next() IObj {
 	return obj.nextObj
 }
@@ -43,10 +145,64 @@ func (os *ObjString) free() {
 	os.length = 0
 }
 
+func (of *ObjFunction) free() {
+	of.chunk.free()
+	of.name = nil
+}
+
+func (ob *ObjBoundMethod) free() {
+	ob.method = nil
+}
+
+func (oc *ObjClass) free() {
+	oc.name = nil
+	oc.methods.free()
+}
+
+func (oi *ObjInstance) free() {
+	oi.fields.free()
+}
+
+func (on *ObjNative) free() {
+	on.function = nil
+}
+
+func (oc *ObjClosure) free() {
+	oc.upvalues = nil
+}
+
+func (ou *ObjUpvalue) free() {
+	ou.nextUpvalue = nil
+}
+
 func (v Value) ObjType() ObjType {
 	return v.asObj().ObjType()
 }
 
+func (v Value) isBoundMethod() bool {
+	return v.isObjType(OBJ_BOUND_METHOD)
+}
+
+func (v Value) isClass() bool {
+	return v.isObjType(OBJ_CLASS)
+}
+
+func (v Value) isInstance() bool {
+	return v.isObjType(OBJ_INSTANCE)
+}
+
+func (v Value) isClosure() bool {
+	return v.isObjType(OBJ_CLOSURE)
+}
+
+func (v Value) isFunction() bool {
+	return v.isObjType(OBJ_FUNCTION)
+}
+
+func (v Value) isNative() bool {
+	return v.isObjType(OBJ_NATIVE)
+}
+
 func (v Value) isString() bool {
 	return v.isObjType(OBJ_STRING)
 }
@@ -55,30 +211,124 @@ func (v Value) isObjType(t ObjType) bool {
 	return v.isType(VAL_OBJ) && v.ObjType() == t
 }
 
-func (v Value) asString() ObjString {
-	obj := v.asObj()
-	objstr := obj.(*ObjString)
-	return *objstr
+func (v Value) asBoundMethod() *ObjBoundMethod {
+	return v.asObj().(*ObjBoundMethod)
+}
+
+func (v Value) asClass() *ObjClass {
+	return v.asObj().(*ObjClass)
+}
+
+func (v Value) asInstance() *ObjInstance {
+	return v.asObj().(*ObjInstance)
+}
+
+func (v Value) asClosure() *ObjClosure {
+	return v.asObj().(*ObjClosure)
+}
+
+func (v Value) asFunction() *ObjFunction {
+	return v.asObj().(*ObjFunction)
+}
+
+func (v Value) asNative() *ObjNative {
+	return v.asObj().(*ObjNative)
+}
+
+func (v Value) asString() *ObjString {
+	return v.asObj().(*ObjString)
 }
 
 func (v Value) asCString() []byte {
 	return []byte(v.asString().str)
 }
 
-func newObjString(str string) *ObjString {
+// allocateString returns the canonical ObjString for str, creating and
+// interning it the first time it is seen. Every string the VM produces goes
+// through here, which is what lets strings be compared by identity.
+func (vm *VM) allocateString(str string) *ObjString {
+	hash := hashString(str)
+	interned := vm.strings.tableFindString(str, hash)
+	if interned != nil {
+		return interned
+	}
+
 	obj := &ObjString{
 		length: len(str),
 		str:    str,
 	}
-	obj.nextObj = vm.objects
-	obj.hash = hashString(str)
-	vm.objects = obj
+	obj.hash = hash
+	vm.allocateObject(obj, int(unsafe.Sizeof(*obj))+len(str))
 
 	vm.strings.tableSet(obj, NIL_VAL())
 
 	return obj
 }
 
+func (vm *VM) newFunction() *ObjFunction {
+	function := &ObjFunction{
+		arity: 0,
+		name:  nil,
+	}
+	vm.allocateObject(function, int(unsafe.Sizeof(*function)))
+	return function
+}
+
+func (vm *VM) newBoundMethod(receiver Value, method *ObjClosure) *ObjBoundMethod {
+	bound := &ObjBoundMethod{
+		receiver: receiver,
+		method:   method,
+	}
+	vm.allocateObject(bound, int(unsafe.Sizeof(*bound)))
+	return bound
+}
+
+func (vm *VM) newClass(name *ObjString) *ObjClass {
+	klass := &ObjClass{
+		name: name,
+	}
+	klass.methods.init()
+	vm.allocateObject(klass, int(unsafe.Sizeof(*klass)))
+	return klass
+}
+
+func (vm *VM) newInstance(klass *ObjClass) *ObjInstance {
+	instance := &ObjInstance{
+		klass: klass,
+	}
+	instance.fields.init()
+	vm.allocateObject(instance, int(unsafe.Sizeof(*instance)))
+	return instance
+}
+
+func (vm *VM) newClosure(function *ObjFunction) *ObjClosure {
+	closure := &ObjClosure{
+		function:     function,
+		upvalues:     make([]*ObjUpvalue, function.upvalueCount),
+		upvalueCount: function.upvalueCount,
+	}
+	vm.allocateObject(closure, int(unsafe.Sizeof(*closure))+function.upvalueCount*int(unsafe.Sizeof(closure)))
+	return closure
+}
+
+func (vm *VM) newNative(arity int, function NativeFn) *ObjNative {
+	native := &ObjNative{
+		arity:    arity,
+		function: function,
+	}
+	vm.allocateObject(native, int(unsafe.Sizeof(*native)))
+	return native
+}
+
+func (vm *VM) newUpvalue(slot int) *ObjUpvalue {
+	upvalue := &ObjUpvalue{
+		location: slot,
+		closed:   NIL_VAL(),
+	}
+	vm.allocateObject(upvalue, int(unsafe.Sizeof(*upvalue)))
+	return upvalue
+}
+
 // todo: replace with hash/fnv Sum32
 func hashString(str string) Hash {
 	hash := 2166136261
@@ -89,9 +339,31 @@ func hashString(str string) Hash {
 	return Hash(hash)
 }
 
-func (v *Value) printObject() {
+func (of *ObjFunction) String() string {
+	if of.name == nil {
+		return "<script>"
+	}
+	return fmt.Sprintf("<fn %s>", of.name.str)
+}
+
+func (v Value) objectString() string {
 	switch v.ObjType() {
+	case OBJ_BOUND_METHOD:
+		return v.asBoundMethod().method.function.String()
+	case OBJ_CLASS:
+		return v.asClass().name.str
+	case OBJ_CLOSURE:
+		return v.asClosure().function.String()
+	case OBJ_FUNCTION:
+		return v.asFunction().String()
+	case OBJ_INSTANCE:
+		return fmt.Sprintf("%s instance", v.asInstance().klass.name.str)
+	case OBJ_NATIVE:
+		return "<native fn>"
 	case OBJ_STRING:
-		fmt.Printf(v.asString().str)
+		return v.asString().str
+	case OBJ_UPVALUE:
+		return "upvalue"
 	}
+	return ""
 }
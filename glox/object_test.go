@@ -5,7 +5,7 @@ import "testing"
 func TestObject(t *testing.T) {
 	vm:=new(VM)
 	vm.Init()
-	source := "\"test\"+\" adidas\""
+	source := "\"test\"+\" adidas\";"
 	// source := "\"test\"==\" adidas\""
 	result := vm.interpret(source)
 	if result != INTERPRET_OK {
@@ -13,3 +13,40 @@ func TestObject(t *testing.T) {
 	}
 	vm.Free()
 }
+
+func TestStringInterning(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+var ab = "a" + "b";
+var global = "conc" + "at";
+print ab == "ab";
+print ("a" + "b") == ("a" + "b");
+print "a" + "b" != "ba";
+print global;
+`
+	result := vm.interpret(source)
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed: %s", source)
+	}
+
+	concatenated, ok := vm.globals.tableGet(vm.allocateString("ab"))
+	if !ok {
+		t.Fatalf("Global 'ab' was not defined")
+	}
+	if concatenated.asString() != vm.allocateString("ab") {
+		t.Errorf("Concatenated string was not interned")
+	}
+	if concatenated.asString().hash != hashString("ab") {
+		t.Errorf("Concatenated string has hash %d", concatenated.asString().hash)
+	}
+
+	// A string built at runtime can be used to look up a global.
+	global, _ := vm.globals.tableGet(vm.allocateString("global"))
+	vm.globals.tableSet(global.asString(), BOOL_VAL(true))
+	result = vm.interpret("print concat;")
+	if result != INTERPRET_OK {
+		t.Errorf("Lookup through a runtime-created name failed")
+	}
+	vm.Free()
+}
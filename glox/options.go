@@ -0,0 +1,90 @@
+package glox
+
+import (
+	"io"
+	"os"
+)
+
+// Options configures a VM. Set them before calling VM.Init; a zero value
+// selects the default for that setting.
+type Options struct {
+	// StackMax is the number of value slots the stack may grow to before
+	// the script fails with a "Stack overflow." runtime error.
+	StackMax int
+	// MaxFrames is the deepest the call stack may get before the script
+	// fails with a "Stack overflow." runtime error. It defaults to
+	// FRAMES_MAX. Deep recursion may also need a larger StackMax.
+	MaxFrames int
+	// MaxInstructions is the number of instructions a single call to
+	// Interpret may execute. Zero means no limit.
+	MaxInstructions int64
+	// MaxHeapBytes caps the bytes held by live objects. Reaching it forces a
+	// collection, and the script fails if it is still over afterwards. Zero
+	// means no limit.
+	MaxHeapBytes int
+
+	// Disassemble prints the bytecode of each function once it compiles.
+	Disassemble bool
+	// TraceExecution prints the stack and the instruction about to run
+	// before every instruction.
+	TraceExecution bool
+	// TraceGC logs every allocation, mark, blacken and free.
+	TraceGC bool
+	// StressGC runs a full collection before every allocation, which
+	// shakes out objects that aren't rooted while they are being built.
+	StressGC bool
+	// DebugOutput receives disassembly and trace output. It defaults to
+	// Stderr so that traces don't mix with the program's own output.
+	DebugOutput io.Writer
+
+	// Stdout receives the output of print statements and the REPL prompt.
+	// It defaults to os.Stdout.
+	Stdout io.Writer
+	// Stderr receives the errors the REPL reports. It defaults to
+	// os.Stderr.
+	Stderr io.Writer
+	// Stdin is read by the REPL. It defaults to os.Stdin.
+	Stdin io.Reader
+}
+
+func (o *Options) stackMax() int {
+	if o.StackMax <= 0 {
+		return STACK_MAX
+	}
+	return o.StackMax
+}
+
+func (o *Options) maxFrames() int {
+	if o.MaxFrames <= 0 {
+		return FRAMES_MAX
+	}
+	return o.MaxFrames
+}
+
+func (o *Options) debugOutput() io.Writer {
+	if o.DebugOutput == nil {
+		return o.stderr()
+	}
+	return o.DebugOutput
+}
+
+func (o *Options) stdout() io.Writer {
+	if o.Stdout == nil {
+		return os.Stdout
+	}
+	return o.Stdout
+}
+
+func (o *Options) stderr() io.Writer {
+	if o.Stderr == nil {
+		return os.Stderr
+	}
+	return o.Stderr
+}
+
+func (o *Options) stdin() io.Reader {
+	if o.Stdin == nil {
+		return os.Stdin
+	}
+	return o.Stdin
+}
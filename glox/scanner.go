@@ -7,6 +7,11 @@ type Scanner struct {
 	start   int
 	current int
 	line    int
+	// lineStart is the offset of the first byte of the current line, and
+	// startLine/startColumn the position where the current token begins.
+	lineStart   int
+	startLine   int
+	startColumn int
 }
 
 // var scanner = new(Scanner)
@@ -16,12 +21,17 @@ func (s *Scanner) init(source string) {
 	s.start = 0
 	s.current = 0
 	s.line = 1
+	s.lineStart = 0
+	s.startLine = 1
+	s.startColumn = 1
 }
 
 func (s *Scanner) scanToken() Token {
 	s.skipWhiteSpace()
 
 	s.start = s.current
+	s.startLine = s.line
+	s.startColumn = s.start - s.lineStart + 1
 	if s.isAtEnd() {
 		return s.makeToken(TOKEN_EOF, "", nil)
 	}
@@ -134,7 +144,7 @@ func isDigit(char byte) bool {
 func (s *Scanner) stringToken() Token {
 	for s.peek() != '"' && !s.isAtEnd() {
 		if s.peek() == '\n' {
-			s.line++
+			s.newLine()
 		}
 		s.advance()
 	}
@@ -159,7 +169,7 @@ func (s *Scanner) skipWhiteSpace() {
 		case '\t':
 			s.advance()
 		case '\n':
-			s.line++
+			s.newLine()
 			s.advance()
 		case '/':
 			if s.peekNext() == '/' {
@@ -175,6 +185,12 @@ func (s *Scanner) skipWhiteSpace() {
 	}
 }
 
+// newLine must be called while s.current still points at the newline.
+func (s *Scanner) newLine() {
+	s.line++
+	s.lineStart = s.current + 1
+}
+
 func (s *Scanner) peek() byte {
 	if s.isAtEnd() {
 		return '\x00'
@@ -223,7 +239,8 @@ func (s *Scanner) makeToken(t TokenType, lexeme string, literal interface{}) Tok
 		tokenType: t,
 		lexeme:    lexeme,
 		literal:   literal,
-		line:      s.line,
+		line:      s.startLine,
+		column:    s.startColumn,
 	}
 	return *token
 }
@@ -8,12 +8,15 @@ import (
 func TestScanner(t *testing.T) {
 	scanner := new(Scanner)
 	tokens := []Token{}
-	src := []string{"and", "class", "else", "false", "for", "fun", "if", "nil", "or", "print", "return", "super", "this", "true", "var", "where"}
+	src := []string{"and", "break", "class", "continue", "else", "false", "for", "fun", "if", "nil", "or", "print", "return", "super", "this", "true", "var", "where"}
 	for _, word := range src {
 		scanner.init(word)
 		tokens = append(tokens, scanner.scanToken())
 	}
 	fmt.Println(tokens)
+	if tokens[1].tokenType != TOKEN_BREAK || tokens[3].tokenType != TOKEN_CONTINUE {
+		t.Errorf("Expected break and continue to scan as keywords, got %v and %v", tokens[1], tokens[3])
+	}
 }
 
 func TestScanChars(t *testing.T) {
@@ -26,3 +29,18 @@ func TestScanChars(t *testing.T) {
 	}
 	fmt.Println(tokens)
 }
+
+func TestScanPositions(t *testing.T) {
+	scanner := new(Scanner)
+	scanner.init("var a = 1;\n  print \"two\nlines\" + a;")
+	expected := []Position{
+		{1, 1}, {1, 5}, {1, 7}, {1, 9}, {1, 10},
+		{2, 3}, {2, 9}, {3, 8}, {3, 10}, {3, 11}, {3, 12},
+	}
+	for _, want := range expected {
+		token := scanner.scanToken()
+		if got := (Position{token.line, token.column}); got != want {
+			t.Errorf("Token %q at %v, want %v", token.lexeme, got, want)
+		}
+	}
+}
@@ -1,36 +1,179 @@
 package glox
 
+const TABLE_MAX_LOAD = 0.75
+
 type Hash uint32
 
 type Hashable interface {
 	hashCode() Hash
 }
 
+// Entry is a slot in the table. An empty slot has a nil key and a nil value,
+// while a tombstone left behind by tableDelete has a nil key and a true
+// value so that probe sequences running through it keep going.
+type Entry struct {
+	key   *ObjString
+	value Value
+}
+
 type Table struct {
-	table map[Hash]Value
+	count    int
+	capacity int
+	entries  []Entry
 }
 
 func (t *Table) init() {
-	t.table = make(map[Hash]Value)
+	t.count = 0
+	t.capacity = 0
+	t.entries = nil
 }
 
 func (t *Table) free() {
-	t.table = make(map[Hash]Value)
+	t.init()
+}
+
+func (t *Table) tableSet(key *ObjString, value Value) bool {
+	if float64(t.count+1) > float64(t.capacity)*TABLE_MAX_LOAD {
+		t.adjustCapacity(growCapacity(t.capacity))
+	}
+
+	entry := findEntry(t.entries, t.capacity, key)
+	isNewKey := entry.key == nil
+	if isNewKey && entry.value.isType(VAL_NIL) {
+		t.count++
+	}
+
+	entry.key = key
+	entry.value = value
+	return isNewKey
+}
+
+func (t *Table) tableGet(key *ObjString) (Value, bool) {
+	if t.count == 0 {
+		return NIL_VAL(), false
+	}
+
+	entry := findEntry(t.entries, t.capacity, key)
+	if entry.key == nil {
+		return NIL_VAL(), false
+	}
+	return entry.value, true
+}
+
+func (t *Table) tableDelete(key *ObjString) bool {
+	if t.count == 0 {
+		return false
+	}
+
+	entry := findEntry(t.entries, t.capacity, key)
+	if entry.key == nil {
+		return false
+	}
+
+	// Place a tombstone in the entry.
+	entry.key = nil
+	entry.value = BOOL_VAL(true)
+	return true
 }
 
-func (t *Table) tableSet(key Hashable, value Value) {
-	t.table[key.hashCode()] = value
+func (t *Table) tableAddAll(to *Table) {
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.key != nil {
+			to.tableSet(entry.key, entry.value)
+		}
+	}
 }
 
-func (t *Table) tableGet(key Hashable) (Value, bool) {
-	value, ok := t.table[key.hashCode()]
-	return value, ok
+// tableFindString looks a string up by its contents rather than by identity,
+// which is what interning needs before a canonical ObjString exists.
+func (t *Table) tableFindString(str string, hash Hash) *ObjString {
+	if t.count == 0 {
+		return nil
+	}
+
+	index := uint32(hash) % uint32(t.capacity)
+	for {
+		entry := &t.entries[index]
+		if entry.key == nil {
+			// Stop if we find an empty non-tombstone entry.
+			if entry.value.isType(VAL_NIL) {
+				return nil
+			}
+		} else if entry.key.length == len(str) &&
+			entry.key.hash == hash &&
+			entry.key.str == str {
+			// We found it.
+			return entry.key
+		}
+
+		index = (index + 1) % uint32(t.capacity)
+	}
 }
 
-func (t *Table) tableDelete(key Hashable) {
-	delete(t.table, key.hashCode())
+// tableRemoveWhite drops every entry whose key was not marked by the current
+// collection, letting the table hold its keys weakly.
+func (t *Table) tableRemoveWhite() {
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.key != nil && !entry.key.isMarked {
+			t.tableDelete(entry.key)
+		}
+	}
+}
+
+func findEntry(entries []Entry, capacity int, key *ObjString) *Entry {
+	index := uint32(key.hash) % uint32(capacity)
+	var tombstone *Entry
+
+	for {
+		entry := &entries[index]
+		if entry.key == nil {
+			if entry.value.isType(VAL_NIL) {
+				// Empty entry.
+				if tombstone != nil {
+					return tombstone
+				}
+				return entry
+			} else if tombstone == nil {
+				// We found a tombstone.
+				tombstone = entry
+			}
+		} else if entry.key == key {
+			// We found the key.
+			return entry
+		}
+
+		index = (index + 1) % uint32(capacity)
+	}
 }
-func (t *Table) tableFind(str string) bool {
-	_, ok := t.table[hashString(str)]
-	return ok
+
+func (t *Table) adjustCapacity(capacity int) {
+	entries := make([]Entry, capacity)
+	for i := range entries {
+		entries[i].value = NIL_VAL()
+	}
+
+	t.count = 0
+	for i := range t.entries {
+		entry := &t.entries[i]
+		if entry.key == nil {
+			continue
+		}
+
+		dest := findEntry(entries, capacity, entry.key)
+		dest.key = entry.key
+		dest.value = entry.value
+		t.count++
+	}
+
+	t.entries = entries
+	t.capacity = capacity
+}
+
+func growCapacity(capacity int) int {
+	if capacity < 8 {
+		return 8
+	}
+	return capacity * 2
 }
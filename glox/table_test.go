@@ -6,26 +6,113 @@ import (
 )
 
 func TestTable(t *testing.T) {
-	vm = new(VM)
+	vm := new(VM)
 	vm.Init()
 	fmt.Println(vm.strings)
-	newObjString("test")
+	vm.allocateString("test")
 	fmt.Println(vm.strings)
-	newObjString("adidas")
+	vm.allocateString("adidas")
 	fmt.Println(vm.strings)
-	newObjString("test")
+	vm.allocateString("test")
 	fmt.Println(vm.strings)
-	newObjString("test")
+	vm.allocateString("test")
 	fmt.Println(vm.strings)
 }
 
 func TestEqual(t *testing.T) {
 	vm := new(VM)
 	vm.Init()
-	source := "\" adidas\"==\" adidas\""
+	source := "\" adidas\"==\" adidas\";"
 	result := vm.interpret(source)
 	if result != INTERPRET_OK {
 		t.Errorf("Interpret failed: %s", source)
 	}
 	vm.Free()
 }
+
+func collidingStrings() (*ObjString, *ObjString) {
+	a := &ObjString{length: 3, str: "foo"}
+	b := &ObjString{length: 3, str: "bar"}
+	a.hash = 42
+	b.hash = 42
+	return a, b
+}
+
+func TestTableCollisions(t *testing.T) {
+	table := new(Table)
+	table.init()
+	a, b := collidingStrings()
+
+	if !table.tableSet(a, NUMBER_VAL(1)) {
+		t.Errorf("Expected %s to be a new key", a.str)
+	}
+	if !table.tableSet(b, NUMBER_VAL(2)) {
+		t.Errorf("Expected %s to be a new key", b.str)
+	}
+	if table.tableSet(a, NUMBER_VAL(3)) {
+		t.Errorf("Expected %s to already be present", a.str)
+	}
+
+	if value, ok := table.tableGet(a); !ok || value.asNumber() != 3 {
+		t.Errorf("Lookup of %s returned %v, %t", a.str, value, ok)
+	}
+	if value, ok := table.tableGet(b); !ok || value.asNumber() != 2 {
+		t.Errorf("Lookup of %s returned %v, %t", b.str, value, ok)
+	}
+
+	if found := table.tableFindString("bar", 42); found != b {
+		t.Errorf("tableFindString returned %v instead of %s", found, b.str)
+	}
+	if found := table.tableFindString("baz", 42); found != nil {
+		t.Errorf("tableFindString found a string that was never added")
+	}
+
+	// Deleting the first key must leave the second reachable through the
+	// tombstone.
+	table.tableDelete(a)
+	if _, ok := table.tableGet(a); ok {
+		t.Errorf("Deleted key %s is still present", a.str)
+	}
+	if value, ok := table.tableGet(b); !ok || value.asNumber() != 2 {
+		t.Errorf("Lookup of %s past a tombstone returned %v, %t", b.str, value, ok)
+	}
+
+	if OBJ_VAL(a).equals(OBJ_VAL(b)) {
+		t.Errorf("Strings with colliding hashes compared equal")
+	}
+}
+
+func TestTableGrowth(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	table := new(Table)
+	table.init()
+	keys := []*ObjString{}
+	for i := 0; i < 100; i++ {
+		key := vm.allocateString(fmt.Sprintf("key%d", i))
+		keys = append(keys, key)
+		table.tableSet(key, NUMBER_VAL(float64(i)))
+	}
+	if float64(table.count) > float64(table.capacity)*TABLE_MAX_LOAD {
+		t.Errorf("Table exceeded its load factor: %d entries in %d slots", table.count, table.capacity)
+	}
+	for i, key := range keys {
+		if value, ok := table.tableGet(key); !ok || value.asNumber() != float64(i) {
+			t.Errorf("Lookup of %s returned %v, %t", key.str, value, ok)
+		}
+	}
+
+	to := new(Table)
+	to.init()
+	table.tableAddAll(to)
+	for i, key := range keys {
+		if value, ok := to.tableGet(key); !ok || value.asNumber() != float64(i) {
+			t.Errorf("Copied lookup of %s returned %v, %t", key.str, value, ok)
+		}
+	}
+
+	if vm.allocateString("key7") != keys[7] {
+		t.Errorf("Expected equal strings to be interned to the same object")
+	}
+	vm.Free()
+}
@@ -33,7 +33,9 @@ const (
 
 	// Keywords.
 	TOKEN_AND
+	TOKEN_BREAK
 	TOKEN_CLASS
+	TOKEN_CONTINUE
 	TOKEN_ELSE
 	TOKEN_FALSE
 	TOKEN_FOR
@@ -58,25 +60,28 @@ type Token struct {
 	lexeme    string
 	literal   interface{}
 	line      int
+	column    int
 }
 
 var Keywords = map[string]TokenType{
-	"and":    TOKEN_AND,
-	"class":  TOKEN_CLASS,
-	"else":   TOKEN_ELSE,
-	"false":  TOKEN_FALSE,
-	"for":    TOKEN_FOR,
-	"fun":    TOKEN_FUN,
-	"if":     TOKEN_IF,
-	"nil":    TOKEN_NIL,
-	"or":     TOKEN_OR,
-	"print":  TOKEN_PRINT,
-	"return": TOKEN_RETURN,
-	"super":  TOKEN_SUPER,
-	"this":   TOKEN_THIS,
-	"true":   TOKEN_TRUE,
-	"var":    TOKEN_VAR,
-	"while":  TOKEN_WHILE,
+	"and":      TOKEN_AND,
+	"break":    TOKEN_BREAK,
+	"class":    TOKEN_CLASS,
+	"continue": TOKEN_CONTINUE,
+	"else":     TOKEN_ELSE,
+	"false":    TOKEN_FALSE,
+	"for":      TOKEN_FOR,
+	"fun":      TOKEN_FUN,
+	"if":       TOKEN_IF,
+	"nil":      TOKEN_NIL,
+	"or":       TOKEN_OR,
+	"print":    TOKEN_PRINT,
+	"return":   TOKEN_RETURN,
+	"super":    TOKEN_SUPER,
+	"this":     TOKEN_THIS,
+	"true":     TOKEN_TRUE,
+	"var":      TOKEN_VAR,
+	"while":    TOKEN_WHILE,
 }
 
 func (t TokenType) String() string {
@@ -127,8 +132,12 @@ func (t TokenType) String() string {
 		return "TOKEN_NUMBER"
 	case TOKEN_AND:
 		return "TOKEN_AND"
+	case TOKEN_BREAK:
+		return "TOKEN_BREAK"
 	case TOKEN_CLASS:
 		return "TOKEN_CLASS"
+	case TOKEN_CONTINUE:
+		return "TOKEN_CONTINUE"
 	case TOKEN_ELSE:
 		return "TOKEN_ELSE"
 	case TOKEN_FALSE:
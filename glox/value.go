@@ -1,10 +1,18 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"math"
+)
 
+// Value is stored inline in 24 bytes, so numbers and booleans never need a
+// heap allocation. Objects live in obj; everything else is NaN-boxed in bits:
+// a number is its float64 bit pattern, while nil, false and true are quiet
+// NaNs with a tag in the low bits that no number ever uses.
 type Value struct {
-	valueType ValueType
-	val       interface{}
+	bits uint64
+	obj  IObj
 }
 
 type ValueArray struct {
@@ -22,70 +30,95 @@ const (
 	VAL_OBJ
 )
 
+const (
+	QNAN uint64 = 0x7ffc000000000000
+	// CANONICAL_NAN replaces any NaN whose bits would collide with a tag.
+	CANONICAL_NAN uint64 = 0x7ff8000000000000
+
+	TAG_NIL   = 1
+	TAG_FALSE = 2
+	TAG_TRUE  = 3
+
+	NIL_BITS   = QNAN | TAG_NIL
+	FALSE_BITS = QNAN | TAG_FALSE
+	TRUE_BITS  = QNAN | TAG_TRUE
+)
+
 func BOOL_VAL(value bool) Value {
-	return Value{
-		valueType: VAL_BOOL,
-		val:       value,
+	if value {
+		return Value{bits: TRUE_BITS}
 	}
-
+	return Value{bits: FALSE_BITS}
 }
+
 func NUMBER_VAL(value float64) Value {
-	return Value{
-		valueType: VAL_NUMBER,
-		val:       value,
+	bits := math.Float64bits(value)
+	if bits&QNAN == QNAN {
+		bits = CANONICAL_NAN
 	}
+	return Value{bits: bits}
 }
 
 func NIL_VAL() Value {
-	return Value{
-		valueType: VAL_NIL,
-		val:       nil,
-	}
+	return Value{bits: NIL_BITS}
 }
 
 func OBJ_VAL(value IObj) Value {
-	return Value{
-		valueType: VAL_OBJ,
-		val:       value,
-	}
+	return Value{obj: value}
 }
 
 func (value Value) asBool() bool {
-	return value.val.(bool)
+	return value.bits == TRUE_BITS
 }
 
 func (value Value) asNumber() float64 {
-	return value.val.(float64)
+	return math.Float64frombits(value.bits)
 }
 
 func (value Value) asObj() IObj {
-	return value.val.(IObj)
+	return value.obj
+}
+
+func (value Value) valueType() ValueType {
+	switch {
+	case value.obj != nil:
+		return VAL_OBJ
+	case value.bits&QNAN != QNAN:
+		return VAL_NUMBER
+	case value.bits == NIL_BITS:
+		return VAL_NIL
+	default:
+		return VAL_BOOL
+	}
 }
 
 func (value Value) isType(valType ValueType) bool {
-	return value.valueType == valType
+	// Checked directly rather than through valueType, as this sits on the
+	// interpreter's hot path.
+	if value.obj != nil {
+		return valType == VAL_OBJ
+	}
+	switch valType {
+	case VAL_NUMBER:
+		return value.bits&QNAN != QNAN
+	case VAL_NIL:
+		return value.bits == NIL_BITS
+	case VAL_BOOL:
+		return value.bits|1 == TRUE_BITS
+	}
+	return false
 }
 
 func (v1 Value) equals(v2 Value) bool {
-	if v1.valueType != v2.valueType {
-		return false
+	if v1.obj != nil || v2.obj != nil {
+		// Strings are interned, so identity is equality for every object
+		// type.
+		return v1.obj == v2.obj
 	}
-	switch v1.valueType {
-	case VAL_BOOL:
-		return v1.asBool() == v2.asBool()
-	case VAL_NIL:
-		return true
-	case VAL_NUMBER:
+	if v1.isType(VAL_NUMBER) && v2.isType(VAL_NUMBER) {
 		return v1.asNumber() == v2.asNumber()
-	case VAL_OBJ:
-		{
-			a := v1.asObj()
-			b := v2.asObj()
-			return a.hashCode() == b.hashCode()
-		}
-	default:
-		return false
 	}
+	return v1.bits == v2.bits
 }
 
 func (array *ValueArray) write(value Value) {
@@ -98,19 +131,67 @@ func (array *ValueArray) free() {
 	array = new(ValueArray)
 }
 
-func printValue(value Value) {
-	switch value.valueType {
+// String formats the value the way the print statement shows it.
+func (value Value) String() string {
+	switch value.valueType() {
 	case VAL_BOOL:
 		if value.asBool() {
-			fmt.Printf("true")
-		} else {
-			fmt.Printf("false")
+			return "true"
 		}
+		return "false"
 	case VAL_NIL:
-		fmt.Printf("nil")
+		return "nil"
 	case VAL_NUMBER:
-		fmt.Printf("%g", value.asNumber())
+		return fmt.Sprintf("%g", value.asNumber())
 	case VAL_OBJ:
-		value.printObject()
+		return value.objectString()
+	}
+	return ""
+}
+
+func printValue(w io.Writer, value Value) {
+	fmt.Fprint(w, value.String())
+}
+
+// IsNil reports whether the value is nil.
+func (value Value) IsNil() bool {
+	return value.isType(VAL_NIL)
+}
+
+// IsBool reports whether the value is a boolean.
+func (value Value) IsBool() bool {
+	return value.isType(VAL_BOOL)
+}
+
+// IsNumber reports whether the value is a number.
+func (value Value) IsNumber() bool {
+	return value.isType(VAL_NUMBER)
+}
+
+// IsString reports whether the value is a string.
+func (value Value) IsString() bool {
+	return value.isString()
+}
+
+// AsBool returns the boolean held by the value, or false if it is not a
+// boolean.
+func (value Value) AsBool() bool {
+	return value.IsBool() && value.asBool()
+}
+
+// AsNumber returns the number held by the value, or 0 if it is not a number.
+func (value Value) AsNumber() float64 {
+	if !value.IsNumber() {
+		return 0
+	}
+	return value.asNumber()
+}
+
+// AsString returns the contents of a string value, or "" if it is not a
+// string.
+func (value Value) AsString() string {
+	if !value.IsString() {
+		return ""
 	}
+	return value.asString().str
 }
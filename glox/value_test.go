@@ -0,0 +1,78 @@
+package glox
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+)
+
+func benchmarkInterpret(b *testing.B, source string) {
+	vm := new(VM)
+	vm.Init()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if result := vm.interpret(source); result != INTERPRET_OK {
+			b.Fatalf("Interpret failed: %s", source)
+		}
+	}
+	b.StopTimer()
+	vm.Free()
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	benchmarkInterpret(b, `
+var sum = 0;
+for (var i = 0; i < 10000; i = i + 1) {
+	sum = sum + i * 2 - i / 2;
+}
+`)
+}
+
+func BenchmarkVariableAccess(b *testing.B) {
+	benchmarkInterpret(b, `
+var global = 0;
+fun run() {
+	var local = 0;
+	for (var i = 0; i < 10000; i = i + 1) {
+		local = local + 1;
+		global = local;
+	}
+}
+run();
+`)
+}
+
+func TestValueLayout(t *testing.T) {
+	if size := unsafe.Sizeof(Value{}); size != 24 {
+		t.Errorf("Value takes %d bytes, want 24", size)
+	}
+
+	// A NaN carrying a tag's bit pattern must still read back as a number.
+	tagged := NUMBER_VAL(math.Float64frombits(NIL_BITS))
+	if !tagged.isType(VAL_NUMBER) || !math.IsNaN(tagged.asNumber()) {
+		t.Errorf("NaN with tag bits decoded as %v", tagged)
+	}
+
+	values := []Value{NIL_VAL(), BOOL_VAL(false), BOOL_VAL(true), NUMBER_VAL(0), NUMBER_VAL(-1.5)}
+	types := []ValueType{VAL_NIL, VAL_BOOL, VAL_BOOL, VAL_NUMBER, VAL_NUMBER}
+	for i, value := range values {
+		if !value.isType(types[i]) {
+			t.Errorf("%v has the wrong type", value)
+		}
+		for j, other := range values {
+			if value.equals(other) != (i == j) {
+				t.Errorf("%v == %v should be %t", value, other, i == j)
+			}
+		}
+	}
+	if !BOOL_VAL(true).asBool() || BOOL_VAL(false).asBool() {
+		t.Errorf("Booleans don't round trip")
+	}
+	if !NUMBER_VAL(0).equals(NUMBER_VAL(math.Copysign(0, -1))) {
+		t.Errorf("Expected 0 == -0")
+	}
+	if nan := NUMBER_VAL(math.NaN()); nan.equals(nan) {
+		t.Errorf("Expected NaN != NaN")
+	}
+}
@@ -2,22 +2,52 @@ package glox
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
 )
 
-const STACK_MAX = 256
+const FRAMES_MAX = 64
+const STACK_MAX = FRAMES_MAX * 256
+const STACK_INITIAL = 256
+
+// CANCEL_CHECK_INTERVAL is how many instructions run between checks of the
+// context. It must be a power of two.
+const CANCEL_CHECK_INTERVAL = 1024
+
+type CallFrame struct {
+	closure *ObjClosure
+	ip      int
+	slots   int
+}
 
 type VM struct {
-	chunk     *Chunk
-	ips       []byte
-	stack     [STACK_MAX]Value
-	stackTop  int
-	currentIP int
-	objects   IObj
-	strings   Table
-	globals   Table
+	Options Options
+
+	frames         []CallFrame
+	frameCount     int
+	stack          []Value
+	stackTop       int
+	openUpvalues   *ObjUpvalue
+	initString     *ObjString
+	objects        IObj
+	grayStack      []IObj
+	bytesAllocated int
+	nextGC         int
+	strings        Table
+	globals        Table
+	// parser is the compilation in progress, if any.
+	parser *Parser
+
+	// lastError is the error that stopped the most recent run, if any.
+	lastError *RuntimeError
+	// result is the value the last run returned, kept as a root until the
+	// next one so the caller can still use it.
+	result Value
+	// nativeValues holds the strings made with String during the current
+	// native call, which nothing else roots until it returns.
+	nativeValues []Value
 }
 
 type InterpretResult byte
@@ -29,43 +59,58 @@ const (
 )
 
 func (vm *VM) Repl() {
+	reader := bufio.NewReader(vm.Options.stdin())
 	for {
-		fmt.Print("> ")
-		reader := bufio.NewReader(os.Stdin)
+		fmt.Fprint(vm.Options.stdout(), "> ")
 		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			fmt.Fprintln(vm.Options.stdout())
+			return
+		}
 		if err != nil {
-			os.Stderr.WriteString("Read error")
+			fmt.Fprintln(vm.Options.stderr(), "Read error:", err)
 			return
 		}
 		vm.interpret(line)
 	}
 }
 
-func (vm *VM) RunFile(path string) {
+// RunFile interprets the script at path, which may hold either source or
+// bytecode written by Compile. Errors are returned rather than reported; see
+// ReportError.
+func (vm *VM) RunFile(path string) error {
 	buffer, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	result := vm.interpret(string(buffer))
-
-	if result == INTERPRET_COMPILE_ERROR {
-		os.Exit(65)
-	}
-	if result == INTERPRET_RUNTIME_ERROR {
-		os.Exit(70)
+	if isBytecode(buffer) {
+		_, err = vm.InterpretBytecode(context.Background(), buffer, path)
+	} else {
+		_, err = vm.Interpret(context.Background(), string(buffer), path)
 	}
+	return err
 }
 
 func (vm *VM) Init() {
+	vm.stack = make([]Value, STACK_INITIAL)
+	vm.frames = make([]CallFrame, FRAMES_MAX)
 	vm.resetStack()
 	vm.objects = nil
+	vm.grayStack = nil
+	vm.bytesAllocated = 0
+	vm.nextGC = GC_INITIAL_THRESHOLD
 	vm.strings.init()
 	vm.globals.init()
+
+	vm.initString = vm.allocateString("init")
+
+	vm.DefineNative("clock", 0, clockNative)
 }
 
 func (vm *VM) resetStack() {
 	vm.stackTop = 0
+	vm.frameCount = 0
+	vm.openUpvalues = nil
 }
 
 func (vm *VM) Free() {
@@ -73,21 +118,17 @@ func (vm *VM) Free() {
 	vm.freeObjects()
 	vm.strings.free()
 	vm.globals.free()
-}
-
-func (vm *VM) freeObjects() {
-	obj := vm.objects
-	for obj != nil && obj.next() != nil {
-		next := obj.next()
-		if next == nil {
-			return
-		}
-		next.free()
-		obj = next
-	}
+	vm.initString = nil
+	vm.result = NIL_VAL()
+	vm.nativeValues = nil
+	vm.stack = nil
+	vm.frames = nil
 }
 
 func (vm *VM) push(value Value) {
+	if vm.stackTop == len(vm.stack) {
+		vm.growStack()
+	}
 	vm.stack[vm.stackTop] = value
 	vm.stackTop++
 }
@@ -97,25 +138,158 @@ func (vm *VM) pop() Value {
 	return value
 }
 
+// Interpret compiles and runs source as the script called name. It returns
+// the value of the last expression statement executed outside any function
+// body, in a block or not, or nil if there was none; an object value stays valid until the next call to
+// Interpret or InterpretBytecode. A failed script returns a *CompileError or
+// a *RuntimeError, and nothing is printed for it. A context that is already
+// done fails with a *RuntimeError wrapping its error, without compiling.
+func (vm *VM) Interpret(ctx context.Context, source string, name string) (Value, error) {
+	vm.result = NIL_VAL()
+	vm.nativeValues = vm.nativeValues[:0]
+	if err := ctx.Err(); err != nil {
+		return NIL_VAL(), stoppedError(name, err)
+	}
+
+	function, diagnostics := vm.compile(source)
+	if function == nil {
+		return NIL_VAL(), &CompileError{
+			Script:      name,
+			Source:      source,
+			Diagnostics: diagnostics,
+		}
+	}
+	return vm.execute(ctx, function, name)
+}
+
+// InterpretBytecode runs a script compiled by Compile. It behaves like
+// Interpret, except that data that isn't valid bytecode for this version
+// of glox fails with an error wrapping ErrInvalidBytecode.
+func (vm *VM) InterpretBytecode(ctx context.Context, data []byte, name string) (Value, error) {
+	vm.result = NIL_VAL()
+	vm.nativeValues = vm.nativeValues[:0]
+	if err := ctx.Err(); err != nil {
+		return NIL_VAL(), stoppedError(name, err)
+	}
+
+	function, err := vm.loadBytecode(data)
+	if err != nil {
+		return NIL_VAL(), err
+	}
+	return vm.execute(ctx, function, name)
+}
+
+// execute runs the top-level function of a script.
+func (vm *VM) execute(ctx context.Context, function *ObjFunction, name string) (Value, error) {
+	vm.lastError = nil
+	vm.push(OBJ_VAL(function))
+	closure := vm.newClosure(function)
+	vm.pop()
+	vm.push(OBJ_VAL(closure))
+	vm.call(closure, 0)
+	// The script's result lives in slot 0; frames keep the closure alive.
+	vm.stack[vm.currentFrame().slots] = NIL_VAL()
+
+	if vm.run(ctx) != INTERPRET_OK {
+		vm.lastError.Script = name
+		return NIL_VAL(), vm.lastError
+	}
+	vm.result = vm.pop()
+	return vm.result, nil
+}
+
+// stoppedError reports a script that never started because its context was
+// already done, the same way the dispatch loop reports one it interrupts.
+func stoppedError(name string, err error) *RuntimeError {
+	return &RuntimeError{
+		Script:  name,
+		Message: fmt.Sprintf("Execution stopped: %v.", err),
+		Cause:   err,
+	}
+}
+
+// interpret runs source the way the REPL does, reporting any error on
+// Options.Stderr.
 func (vm *VM) interpret(source string) InterpretResult {
-	chunk := new(Chunk)
-	if !vm.compile(source, chunk) {
+	_, err := vm.Interpret(context.Background(), source, "script")
+	ReportError(vm.Options.stderr(), err)
+	switch err.(type) {
+	case nil:
+		return INTERPRET_OK
+	case *CompileError:
 		return INTERPRET_COMPILE_ERROR
+	default:
+		return INTERPRET_RUNTIME_ERROR
+	}
+}
+
+// growStack doubles the stack. Upvalues refer to stack slots by index, so
+// nothing needs fixing up after the copy; the limit is enforced separately
+// by the dispatch loop.
+func (vm *VM) growStack() {
+	capacity := len(vm.stack) * 2
+	if capacity < STACK_INITIAL {
+		capacity = STACK_INITIAL
+	}
+	stack := make([]Value, capacity)
+	copy(stack, vm.stack)
+	vm.stack = stack
+}
+
+// growFrames doubles the call stack, up to Options.MaxFrames. Frames are
+// always reached through vm.frames, so no pointer into the old array
+// outlives the copy.
+func (vm *VM) growFrames() {
+	capacity := len(vm.frames) * 2
+	if capacity < FRAMES_MAX {
+		capacity = FRAMES_MAX
+	}
+	if max := vm.Options.maxFrames(); capacity > max {
+		capacity = max
 	}
-	vm.chunk = chunk
-	vm.ips = vm.chunk.code
-	result := vm.run()
-	return result
+	frames := make([]CallFrame, capacity)
+	copy(frames, vm.frames)
+	vm.frames = frames
 }
 
-func (vm *VM) run() InterpretResult {
+func (vm *VM) run(ctx context.Context) InterpretResult {
+	stackMax := vm.Options.stackMax()
+	maxInstructions := vm.Options.MaxInstructions
+	done := ctx.Done()
+	trace := vm.Options.TraceExecution
+	out := vm.Options.debugOutput()
+	stdout := vm.Options.stdout()
+	var executed int64
 	for {
-		if DEBUG_TRACE_EXECUTION {
-			fmt.Printf("          ")
-			fmt.Println(vm.stack[:vm.stackTop])
+		if vm.stackTop > stackMax {
+			vm.limitError(ErrStackOverflow, "Stack overflow.")
+			return INTERPRET_RUNTIME_ERROR
+		}
+
+		executed++
+		if maxInstructions > 0 && executed > maxInstructions {
+			vm.limitError(ErrInstructionLimit, "Instruction limit of %d exceeded.", maxInstructions)
+			return INTERPRET_RUNTIME_ERROR
+		}
+		if vm.overHeapLimit() {
+			vm.limitError(ErrHeapLimit, "Heap limit of %d bytes exceeded.", vm.Options.MaxHeapBytes)
+			return INTERPRET_RUNTIME_ERROR
+		}
+		if done != nil && executed&(CANCEL_CHECK_INTERVAL-1) == 0 {
+			select {
+			case <-done:
+				vm.limitError(ctx.Err(), "Execution stopped: %v.", ctx.Err())
+				return INTERPRET_RUNTIME_ERROR
+			default:
+			}
+		}
 
-			chunk := vm.getChunk()
-			disassembleInstruction(chunk, vm.currentIP-chunk.currentCode)
+		if trace {
+			fmt.Fprintf(out, "          ")
+			fmt.Fprintln(out, vm.stack[:vm.stackTop])
+
+			frame := vm.currentFrame()
+			disassembleInstruction(out, &frame.closure.function.chunk, frame.ip)
 		}
 
 		instruction := OpCode(vm.READ_BYTE())
@@ -125,6 +299,11 @@ func (vm *VM) run() InterpretResult {
 				constant := vm.READ_CONSTANT()
 				vm.push(constant)
 			}
+		case OP_CONSTANT_LONG:
+			{
+				constant := vm.READ_CONSTANT_LONG()
+				vm.push(constant)
+			}
 		case OP_NIL:
 			vm.push(NIL_VAL())
 		case OP_TRUE:
@@ -136,37 +315,80 @@ func (vm *VM) run() InterpretResult {
 		case OP_GET_LOCAL:
 			{
 				slot := vm.READ_BYTE()
-				vm.push(vm.stack[slot])
+				vm.push(vm.stack[vm.currentFrame().slots+int(slot)])
+			}
+		case OP_GET_LOCAL_LONG:
+			{
+				slot := vm.READ_LONG()
+				vm.push(vm.stack[vm.currentFrame().slots+slot])
 			}
 		case OP_SET_LOCAL:
 			{
 				slot := vm.READ_BYTE()
-				vm.stack[slot] = vm.peek(0)
+				vm.stack[vm.currentFrame().slots+int(slot)] = vm.peek(0)
 			}
-		case OP_GET_GLOBAL:
+		case OP_SET_LOCAL_LONG:
 			{
-				name := vm.READ_STRING()
-				value, ok := vm.globals.tableGet(&name)
-				if !ok {
-					vm.runtimeError("Undefined variable '%s'.", name.str)
-					return INTERPRET_RUNTIME_ERROR
-				}
-				vm.push(value)
+				slot := vm.READ_LONG()
+				vm.stack[vm.currentFrame().slots+slot] = vm.peek(0)
+			}
+		case OP_GET_GLOBAL:
+			if !vm.getGlobal(vm.READ_STRING()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_GLOBAL_LONG:
+			if !vm.getGlobal(vm.READ_STRING_LONG()) {
+				return INTERPRET_RUNTIME_ERROR
 			}
 		case OP_DEFINE_GLOBAL:
+			vm.defineGlobal(vm.READ_STRING())
+		case OP_DEFINE_GLOBAL_LONG:
+			vm.defineGlobal(vm.READ_STRING_LONG())
+		case OP_SET_GLOBAL:
+			if !vm.setGlobal(vm.READ_STRING()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SET_GLOBAL_LONG:
+			if !vm.setGlobal(vm.READ_STRING_LONG()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_UPVALUE:
 			{
-				name := vm.READ_STRING()
-				vm.globals.tableSet(&name, vm.peek(0))
-				vm.pop()
+				slot := vm.READ_BYTE()
+				vm.push(vm.currentFrame().closure.upvalues[slot].get(vm))
 			}
-		case OP_SET_GLOBAL:
+		case OP_SET_UPVALUE:
 			{
-				name := vm.READ_STRING()
-				if !vm.globals.tableFind(name.str) {
-					vm.runtimeError("Undefined variable '%s'.", name.str)
-					return INTERPRET_RUNTIME_ERROR
-				}
-				vm.globals.tableSet(&name, vm.peek(0))
+				slot := vm.READ_BYTE()
+				vm.currentFrame().closure.upvalues[slot].set(vm, vm.peek(0))
+			}
+		case OP_GET_PROPERTY:
+			if !vm.getProperty(vm.READ_STRING()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_PROPERTY_LONG:
+			if !vm.getProperty(vm.READ_STRING_LONG()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SET_PROPERTY:
+			if !vm.setProperty(vm.READ_STRING()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SET_PROPERTY_LONG:
+			if !vm.setProperty(vm.READ_STRING_LONG()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_SUPER:
+			name := vm.READ_STRING()
+			superclass, ok := vm.popSuperclass()
+			if !ok || !vm.bindMethod(superclass, name) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_SUPER_LONG:
+			name := vm.READ_STRING_LONG()
+			superclass, ok := vm.popSuperclass()
+			if !ok || !vm.bindMethod(superclass, name) {
+				return INTERPRET_RUNTIME_ERROR
 			}
 		case OP_EQUAL:
 			{
@@ -175,9 +397,13 @@ func (vm *VM) run() InterpretResult {
 				vm.push(BOOL_VAL(a.equals(b)))
 			}
 		case OP_GREATER:
-			vm.BINARY_OP('>')
+			if vm.BINARY_OP('>') != INTERPRET_OK {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_LESS:
-			vm.BINARY_OP('<')
+			if vm.BINARY_OP('<') != INTERPRET_OK {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_ADD:
 			v1 := vm.peek(0)
 			v2 := vm.peek(1)
@@ -192,11 +418,17 @@ func (vm *VM) run() InterpretResult {
 				return INTERPRET_RUNTIME_ERROR
 			}
 		case OP_SUBSTRACT:
-			vm.BINARY_OP('-')
+			if vm.BINARY_OP('-') != INTERPRET_OK {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_MULTIPLY:
-			vm.BINARY_OP('*')
+			if vm.BINARY_OP('*') != INTERPRET_OK {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_DIVIDE:
-			vm.BINARY_OP('/')
+			if vm.BINARY_OP('/') != INTERPRET_OK {
+				return INTERPRET_RUNTIME_ERROR
+			}
 		case OP_NOT:
 			vm.push(BOOL_VAL(isFalsey(vm.pop())))
 		case OP_NEGATE:
@@ -209,13 +441,114 @@ func (vm *VM) run() InterpretResult {
 			}
 		case OP_PRINT:
 			{
-				printValue(vm.pop())
-				fmt.Println()
+				printValue(stdout, vm.pop())
+				fmt.Fprintln(stdout)
+			}
+		case OP_JUMP:
+			{
+				offset := vm.READ_SHORT()
+				vm.currentFrame().ip += int(offset)
 			}
+		case OP_JUMP_IF_FALSE:
+			{
+				offset := vm.READ_SHORT()
+				if isFalsey(vm.peek(0)) {
+					vm.currentFrame().ip += int(offset)
+				}
+			}
+		case OP_LOOP:
+			{
+				offset := vm.READ_SHORT()
+				vm.currentFrame().ip -= int(offset)
+			}
+		case OP_CALL:
+			{
+				argCount := int(vm.READ_BYTE())
+				if !vm.callValue(vm.peek(argCount), argCount) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+			}
+		case OP_INVOKE:
+			{
+				method := vm.READ_STRING()
+				argCount := int(vm.READ_BYTE())
+				if !vm.invoke(method, argCount) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+			}
+		case OP_INVOKE_LONG:
+			{
+				method := vm.READ_STRING_LONG()
+				argCount := int(vm.READ_BYTE())
+				if !vm.invoke(method, argCount) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+			}
+		case OP_SUPER_INVOKE:
+			{
+				method := vm.READ_STRING()
+				argCount := int(vm.READ_BYTE())
+				superclass, ok := vm.popSuperclass()
+				if !ok || !vm.invokeFromClass(superclass, method, argCount) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+			}
+		case OP_SUPER_INVOKE_LONG:
+			{
+				method := vm.READ_STRING_LONG()
+				argCount := int(vm.READ_BYTE())
+				superclass, ok := vm.popSuperclass()
+				if !ok || !vm.invokeFromClass(superclass, method, argCount) {
+					return INTERPRET_RUNTIME_ERROR
+				}
+			}
+		case OP_CLOSURE:
+			vm.makeClosure(vm.READ_CONSTANT().asFunction())
+		case OP_CLOSURE_LONG:
+			vm.makeClosure(vm.READ_CONSTANT_LONG().asFunction())
+		case OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.stackTop - 1)
+			vm.pop()
 		case OP_RETURN:
 			{
-				// Exit interpreter
-				return INTERPRET_OK
+				result := vm.pop()
+				vm.closeUpvalues(vm.currentFrame().slots)
+				vm.frameCount--
+				vm.stackTop = vm.frames[vm.frameCount].slots
+				vm.push(result)
+				if vm.frameCount == 0 {
+					// Exit interpreter, leaving the script's result on
+					// the stack for Interpret.
+					return INTERPRET_OK
+				}
+			}
+		case OP_CLASS:
+			vm.push(OBJ_VAL(vm.newClass(vm.READ_STRING())))
+		case OP_CLASS_LONG:
+			vm.push(OBJ_VAL(vm.newClass(vm.READ_STRING_LONG())))
+		case OP_INHERIT:
+			{
+				superclass := vm.peek(1)
+				if !superclass.isClass() {
+					vm.runtimeError("Superclass must be a class.")
+					return INTERPRET_RUNTIME_ERROR
+				}
+				if !vm.peek(0).isClass() {
+					vm.runtimeError("Subclass must be a class.")
+					return INTERPRET_RUNTIME_ERROR
+				}
+
+				subclass := vm.peek(0).asClass()
+				superclass.asClass().methods.tableAddAll(&subclass.methods)
+				vm.pop() // Subclass.
+			}
+		case OP_METHOD:
+			if !vm.defineMethod(vm.READ_STRING()) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_METHOD_LONG:
+			if !vm.defineMethod(vm.READ_STRING_LONG()) {
+				return INTERPRET_RUNTIME_ERROR
 			}
 		}
 	}
@@ -225,6 +558,264 @@ func (vm *VM) peek(offset int) Value {
 	return vm.stack[vm.stackTop-1-offset]
 }
 
+func (vm *VM) call(closure *ObjClosure, argCount int) bool {
+	if argCount != closure.function.arity {
+		vm.runtimeError("Expected %d arguments but got %d.", closure.function.arity, argCount)
+		return false
+	}
+
+	if vm.frameCount >= vm.Options.maxFrames() {
+		vm.limitError(ErrStackOverflow, "Stack overflow.")
+		return false
+	}
+	if vm.frameCount == len(vm.frames) {
+		vm.growFrames()
+	}
+
+	frame := &vm.frames[vm.frameCount]
+	vm.frameCount++
+	frame.closure = closure
+	frame.ip = 0
+	frame.slots = vm.stackTop - argCount - 1
+	return true
+}
+
+func (vm *VM) callValue(callee Value, argCount int) bool {
+	if callee.isType(VAL_OBJ) {
+		switch callee.ObjType() {
+		case OBJ_BOUND_METHOD:
+			bound := callee.asBoundMethod()
+			vm.stack[vm.stackTop-argCount-1] = bound.receiver
+			return vm.call(bound.method, argCount)
+		case OBJ_CLASS:
+			klass := callee.asClass()
+			vm.stack[vm.stackTop-argCount-1] = OBJ_VAL(vm.newInstance(klass))
+			if initializer, ok := klass.methods.tableGet(vm.initString); ok {
+				return vm.call(initializer.asClosure(), argCount)
+			} else if argCount != 0 {
+				vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+				return false
+			}
+			return true
+		case OBJ_CLOSURE:
+			return vm.call(callee.asClosure(), argCount)
+		case OBJ_NATIVE:
+			native := callee.asNative()
+			if argCount != native.arity {
+				vm.runtimeError("Expected %d arguments but got %d.", native.arity, argCount)
+				return false
+			}
+
+			args := make([]Value, argCount)
+			copy(args, vm.stack[vm.stackTop-argCount:vm.stackTop])
+			result, err := native.function(args)
+			vm.nativeValues = vm.nativeValues[:0]
+			if err != nil {
+				vm.runtimeError("%s", err.Error())
+				return false
+			}
+			vm.stackTop -= argCount + 1
+			vm.push(result)
+			return true
+		default:
+			// Non-callable object type.
+		}
+	}
+	vm.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+func (vm *VM) invokeFromClass(klass *ObjClass, name *ObjString, argCount int) bool {
+	method, ok := klass.methods.tableGet(name)
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name.str)
+		return false
+	}
+	return vm.call(method.asClosure(), argCount)
+}
+
+func (vm *VM) invoke(name *ObjString, argCount int) bool {
+	receiver := vm.peek(argCount)
+
+	if !receiver.isInstance() {
+		vm.runtimeError("Only instances have methods.")
+		return false
+	}
+
+	instance := receiver.asInstance()
+
+	if value, ok := instance.fields.tableGet(name); ok {
+		vm.stack[vm.stackTop-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	return vm.invokeFromClass(instance.klass, name, argCount)
+}
+
+func (vm *VM) bindMethod(klass *ObjClass, name *ObjString) bool {
+	method, ok := klass.methods.tableGet(name)
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name.str)
+		return false
+	}
+
+	bound := vm.newBoundMethod(vm.peek(0), method.asClosure())
+	vm.pop()
+	vm.push(OBJ_VAL(bound))
+	return true
+}
+
+func (vm *VM) captureUpvalue(slot int) *ObjUpvalue {
+	var prevUpvalue *ObjUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.location > slot {
+		prevUpvalue = upvalue
+		upvalue = upvalue.nextUpvalue
+	}
+
+	if upvalue != nil && upvalue.location == slot {
+		return upvalue
+	}
+
+	createdUpvalue := vm.newUpvalue(slot)
+	createdUpvalue.nextUpvalue = upvalue
+
+	if prevUpvalue == nil {
+		vm.openUpvalues = createdUpvalue
+	} else {
+		prevUpvalue.nextUpvalue = createdUpvalue
+	}
+
+	return createdUpvalue
+}
+
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.location >= last {
+		upvalue := vm.openUpvalues
+		upvalue.closed = vm.stack[upvalue.location]
+		upvalue.location = -1
+		vm.openUpvalues = upvalue.nextUpvalue
+	}
+}
+
+func (upvalue *ObjUpvalue) get(vm *VM) Value {
+	if upvalue.location == -1 {
+		return upvalue.closed
+	}
+	return vm.stack[upvalue.location]
+}
+
+func (upvalue *ObjUpvalue) set(vm *VM, value Value) {
+	if upvalue.location == -1 {
+		upvalue.closed = value
+		return
+	}
+	vm.stack[upvalue.location] = value
+}
+
+func (vm *VM) getProperty(name *ObjString) bool {
+	if !vm.peek(0).isInstance() {
+		vm.runtimeError("Only instances have properties.")
+		return false
+	}
+
+	instance := vm.peek(0).asInstance()
+	if value, ok := instance.fields.tableGet(name); ok {
+		vm.pop() // Instance.
+		vm.push(value)
+		return true
+	}
+
+	return vm.bindMethod(instance.klass, name)
+}
+
+func (vm *VM) setProperty(name *ObjString) bool {
+	if !vm.peek(1).isInstance() {
+		vm.runtimeError("Only instances have fields.")
+		return false
+	}
+
+	instance := vm.peek(1).asInstance()
+	instance.fields.tableSet(name, vm.peek(0))
+
+	value := vm.pop()
+	vm.pop() // Instance.
+	vm.push(value)
+	return true
+}
+
+// makeClosure wraps function in a closure, reading the flags and index of
+// each of its upvalues from the instruction stream.
+func (vm *VM) makeClosure(function *ObjFunction) {
+	closure := vm.newClosure(function)
+	vm.push(OBJ_VAL(closure))
+	frame := vm.currentFrame()
+	for i := 0; i < closure.upvalueCount; i++ {
+		flags := vm.READ_BYTE()
+		var index int
+		if flags&UPVALUE_LONG != 0 {
+			index = vm.READ_LONG()
+		} else {
+			index = int(vm.READ_BYTE())
+		}
+		if flags&UPVALUE_LOCAL != 0 {
+			closure.upvalues[i] = vm.captureUpvalue(frame.slots + index)
+		} else {
+			closure.upvalues[i] = frame.closure.upvalues[index]
+		}
+	}
+}
+
+func (vm *VM) getGlobal(name *ObjString) bool {
+	value, ok := vm.globals.tableGet(name)
+	if !ok {
+		vm.runtimeError("Undefined variable '%s'.", name.str)
+		return false
+	}
+	vm.push(value)
+	return true
+}
+
+func (vm *VM) defineGlobal(name *ObjString) {
+	vm.globals.tableSet(name, vm.peek(0))
+	vm.pop()
+}
+
+func (vm *VM) setGlobal(name *ObjString) bool {
+	if vm.globals.tableSet(name, vm.peek(0)) {
+		vm.globals.tableDelete(name)
+		vm.runtimeError("Undefined variable '%s'.", name.str)
+		return false
+	}
+	return true
+}
+
+// defineMethod adds the closure on top of the stack to the class below it.
+// The compiler never emits anything else there, but a bytecode file might,
+// and every method is later called as a closure.
+func (vm *VM) defineMethod(name *ObjString) bool {
+	method := vm.peek(0)
+	if !vm.peek(1).isClass() || !method.isClosure() {
+		vm.runtimeError("Methods can only be closures defined on classes.")
+		return false
+	}
+	klass := vm.peek(1).asClass()
+	klass.methods.tableSet(name, method)
+	vm.pop()
+	return true
+}
+
+// popSuperclass pops the class a super expression resolved to. Source can
+// only put a class there, but a bytecode file could put anything.
+func (vm *VM) popSuperclass() (*ObjClass, bool) {
+	superclass := vm.pop()
+	if !superclass.isClass() {
+		vm.runtimeError("Superclass must be a class.")
+		return nil, false
+	}
+	return superclass.asClass(), true
+}
+
 func isFalsey(value Value) bool {
 	//nil is falsey
 	if value.isType(VAL_NIL) {
@@ -239,46 +830,84 @@ func isFalsey(value Value) bool {
 }
 
 func (vm *VM) concatenate() {
-	b := vm.pop().asString()
-	a := vm.pop().asString()
-	length := b.length + a.length
-	str := a.str + b.str
-	result := ObjString{
-		length: length,
-		str:    str,
-	}
-	vm.push(OBJ_VAL(&result))
+	// Keep both operands on the stack while allocating so a collection
+	// triggered by the new string can't reclaim them.
+	b := vm.peek(0).asString()
+	a := vm.peek(1).asString()
+	result := vm.allocateString(a.str + b.str)
+	vm.pop()
+	vm.pop()
+	vm.push(OBJ_VAL(result))
 }
 
 func (vm *VM) runtimeError(format string, a ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", a)
+	err := &RuntimeError{Message: fmt.Sprintf(format, a...)}
+
+	for i := vm.frameCount - 1; i >= 0; i-- {
+		frame := &vm.frames[i]
+		function := frame.closure.function
+		// ip has already moved past the instruction that failed.
+		position := function.chunk.positionAt(frame.ip - 1)
+		name := "script"
+		if function.name != nil {
+			name = function.name.str
+		}
+		err.Frames = append(err.Frames, StackFrame{name, position.line, position.column})
+	}
 
-	instruction := vm.currentIP - vm.chunk.currentCode - 1
-	line := vm.chunk.lines[instruction]
-	fmt.Fprintf(os.Stderr, "[line %d] in script\n", line)
+	vm.lastError = err
 	vm.resetStack()
 }
 
+// limitError reports a runtime error caused by reaching a limit rather than
+// by the script itself, so callers can tell them apart with errors.Is.
+func (vm *VM) limitError(cause error, format string, a ...interface{}) {
+	vm.runtimeError(format, a...)
+	vm.lastError.Cause = cause
+}
+
 func (vm *VM) READ_BYTE() byte {
-	code := vm.getIP()
-	vm.currentIP++
+	frame := vm.currentFrame()
+	code := frame.closure.function.chunk.code[frame.ip]
+	frame.ip++
 	return code
 }
 
+func (vm *VM) READ_SHORT() uint16 {
+	hi := vm.READ_BYTE()
+	lo := vm.READ_BYTE()
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func (vm *VM) READ_LONG() int {
+	hi := vm.READ_BYTE()
+	mid := vm.READ_BYTE()
+	lo := vm.READ_BYTE()
+	return int(hi)<<16 | int(mid)<<8 | int(lo)
+}
+
 func (vm *VM) READ_CONSTANT() Value {
 	return vm.getChunk().constants.values[vm.READ_BYTE()]
 }
 
-func (vm *VM) READ_STRING() ObjString {
+func (vm *VM) READ_CONSTANT_LONG() Value {
+	return vm.getChunk().constants.values[vm.READ_LONG()]
+}
+
+func (vm *VM) READ_STRING() *ObjString {
 	return vm.READ_CONSTANT().asString()
 }
 
+func (vm *VM) READ_STRING_LONG() *ObjString {
+	return vm.READ_CONSTANT_LONG().asString()
+}
+
 func (vm *VM) getChunk() *Chunk {
-	return vm.chunk
+	return &vm.currentFrame().closure.function.chunk
 }
 
-func (vm *VM) getIP() byte {
-	return vm.ips[vm.currentIP]
+func (vm *VM) currentFrame() *CallFrame {
+	return &vm.frames[vm.frameCount-1]
 }
 
 func (vm *VM) BINARY_OP(op rune) InterpretResult {
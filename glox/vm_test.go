@@ -1,18 +1,643 @@
 package glox
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestVm(t *testing.T) {
 	chunk := new(Chunk)
 	chunk.writeConstant(1.2, 1)
 	chunk.writeConstant(3.4, 1)
-	chunk.write(byte(OP_ADD), 1)
+	chunk.write(byte(OP_ADD), 1, 1)
 
 	chunk.writeConstant(5.6,1)
-	chunk.write(byte(OP_DIVIDE),1)
+	chunk.write(byte(OP_DIVIDE), 1, 1)
 
-	chunk.write(byte(OP_NEGATE),1)
+	chunk.write(byte(OP_NEGATE), 1, 1)
 
-	chunk.write(byte(OP_RETURN), 1)
-	disassemble(chunk, "test chunk")
+	chunk.write(byte(OP_RETURN), 1, 1)
+	disassemble(os.Stdout, chunk, "test chunk")
+}
+
+// expectOutput interprets source on vm and checks what it printed.
+func expectOutput(t *testing.T, vm *VM, source string, want string) {
+	t.Helper()
+	var out strings.Builder
+	vm.Options.Stdout = &out
+	defer func() { vm.Options.Stdout = nil }()
+
+	if result := vm.interpret(source); result != INTERPRET_OK {
+		t.Errorf("Interpret failed: %s", source)
+	}
+	if out.String() != want {
+		t.Errorf("Printed %q, want %q", out.String(), want)
+	}
+}
+
+func TestControlFlow(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+var a = 1;
+if (a == 1) print "then"; else print "else";
+if (a != 1) print "then"; else print "else";
+if (nil) print "unreachable";
+print false and a;
+print nil or "or";
+print true and "and";
+`
+	expectOutput(t, vm, source, "then\nelse\nfalse\nor\nand\n")
+	vm.Free()
+}
+
+func TestLoops(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+var i = 0;
+while (i < 3) {
+	print i;
+	i = i + 1;
+}
+for (var j = 0; j < 3; j = j + 1) print j;
+var k = 0;
+for (; k < 2;) k = k + 1;
+print k;
+`
+	expectOutput(t, vm, source, "0\n1\n2\n0\n1\n2\n2\n")
+	vm.Free()
+}
+
+func TestBreakContinue(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+for (var i = 0; i < 10; i = i + 1) {
+	var skip = i - 2;
+	if (skip < 0) continue;
+	var stop = i;
+	if (stop > 4) break;
+	print i;
+}
+var outer = 0;
+while (outer < 3) {
+	outer = outer + 1;
+	var inner = 0;
+	while (true) {
+		var x = inner;
+		inner = inner + 1;
+		if (x == outer) break;
+	}
+	print inner;
+}
+`
+	expectOutput(t, vm, source, "2\n3\n4\n2\n3\n4\n")
+	vm.Free()
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	for _, source := range []string{"break;", "continue;", "{ var a = 1; break; }"} {
+		result := vm.interpret(source)
+		if result != INTERPRET_COMPILE_ERROR {
+			t.Errorf("Expected compile error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func TestFunctions(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+fun fib(n) {
+	if (n < 2) return n;
+	return fib(n - 2) + fib(n - 1);
+}
+print fib(10);
+fun noReturn() {}
+print noReturn();
+print fib;
+{
+	fun local(a, b) { return a + b; }
+	print local(1, 2);
+}
+`
+	expectOutput(t, vm, source, "55\nnil\n<fn fib>\n3\n")
+	vm.Free()
+}
+
+func TestCallErrors(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	runtimeErrors := []string{
+		"fun f(a) {} f();",
+		"var notFn = 1; notFn();",
+		"fun loop() { loop(); } loop();",
+	}
+	for _, source := range runtimeErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_RUNTIME_ERROR {
+			t.Errorf("Expected runtime error: %s", source)
+		}
+	}
+	compileErrors := []string{
+		"return 1;",
+		"{ var a = a; }",
+	}
+	for _, source := range compileErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_COMPILE_ERROR {
+			t.Errorf("Expected compile error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func TestClosures(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+fun makeCounter() {
+	var i = 0;
+	fun count() {
+		i = i + 1;
+		return i;
+	}
+	return count;
+}
+var counter = makeCounter();
+print counter();
+print counter();
+
+fun outer() {
+	var x = "outside";
+	fun middle() {
+		fun inner() {
+			print x;
+		}
+		return inner;
+	}
+	return middle;
+}
+outer()()();
+
+var callbacks;
+var last;
+for (var i = 0; i < 3; i = i + 1) {
+	var captured = i;
+	fun show() { print captured; }
+	if (i == 1) { callbacks = show; continue; }
+	last = show;
+}
+callbacks();
+last();
+`
+	expectOutput(t, vm, source, "1\n2\noutside\n1\n2\n")
+	vm.Free()
+}
+
+func TestClasses(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+class Pair {}
+print Pair;
+var pair = Pair();
+print pair;
+pair.first = 1;
+pair.second = 2;
+print pair.first + pair.second;
+pair.first = pair.second = 3;
+print pair.first;
+`
+	expectOutput(t, vm, source, "Pair\nPair instance\n3\n3\n")
+
+	runtimeErrors := []string{
+		"class A {} var a = A(); print a.missing;",
+		"var n = 1; print n.field;",
+		"var n = 1; n.field = 2;",
+	}
+	for _, source := range runtimeErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_RUNTIME_ERROR {
+			t.Errorf("Expected runtime error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func TestMethods(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+class Scone {
+	init(topping) {
+		this.topping = topping;
+	}
+	describe(extra) {
+		return "scone with " + this.topping + extra;
+	}
+}
+var scone = Scone("berries");
+print scone.describe(" and cream");
+var describe = scone.describe;
+print describe("!");
+print scone.init("jam");
+print scone.topping;
+
+class Nested {
+	method() {
+		fun inner() { return this; }
+		return inner();
+	}
+}
+print Nested().method();
+
+class Field {}
+var f = Field();
+fun greet() { return "field function"; }
+f.greet = greet;
+print f.greet();
+`
+	expectOutput(t, vm, source, "scone with berries and cream\nscone with berries!\nScone instance\njam\nNested instance\nfield function\n")
+
+	runtimeErrors := []string{
+		"class A { init(a) {} } A();",
+		"class B {} B(1);",
+		"class C {} C().missing();",
+		"var n = 1; n.method();",
+	}
+	for _, source := range runtimeErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_RUNTIME_ERROR {
+			t.Errorf("Expected runtime error: %s", source)
+		}
+	}
+
+	compileErrors := []string{
+		"print this;",
+		"fun f() { return this; }",
+		"class A { init() { return 1; } }",
+	}
+	for _, source := range compileErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_COMPILE_ERROR {
+			t.Errorf("Expected compile error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func TestInheritance(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := `
+class Doughnut {
+	init(name) { this.name = name; }
+	cook() { return "Fry " + this.name; }
+}
+class Cruller < Doughnut {
+	cook() {
+		var base = super.cook;
+		return base() + " until golden, then " + super.cook();
+	}
+}
+var c = Cruller("cruller");
+print c.cook();
+{
+	class Local < Cruller {}
+	print Local("local").cook();
+}
+`
+	expectOutput(t, vm, source, "Fry cruller until golden, then Fry cruller\nFry local until golden, then Fry local\n")
+
+	runtimeErrors := []string{
+		"var NotClass = 1; class A < NotClass {}",
+		"class A {} class B < A { m() { return super.missing(); } } B().m();",
+	}
+	for _, source := range runtimeErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_RUNTIME_ERROR {
+			t.Errorf("Expected runtime error: %s", source)
+		}
+	}
+
+	compileErrors := []string{
+		"class A < A {}",
+		"print super.method();",
+		"class A { m() { return super.m(); } }",
+	}
+	for _, source := range compileErrors {
+		result := vm.interpret(source)
+		if result != INTERPRET_COMPILE_ERROR {
+			t.Errorf("Expected compile error: %s", source)
+		}
+	}
+	vm.Free()
+}
+
+func nestedExpression(depth int) string {
+	// A local keeps the expression from running into the constant limit.
+	return "{ var a = 1; print " + strings.Repeat("a + (", depth) + "a" + strings.Repeat(")", depth) + "; }"
+}
+
+func TestStackGrowth(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	source := nestedExpression(1000)
+	result := vm.interpret(source)
+	if result != INTERPRET_OK {
+		t.Errorf("Interpret failed for an expression nested 1000 deep")
+	}
+	if len(vm.stack) <= STACK_INITIAL {
+		t.Errorf("Expected the stack to grow past %d slots", STACK_INITIAL)
+	}
+	vm.Free()
+}
+
+func TestStackOverflow(t *testing.T) {
+	vm := new(VM)
+	vm.Options.StackMax = 64
+	vm.Init()
+	result := vm.interpret(nestedExpression(100))
+	if result != INTERPRET_RUNTIME_ERROR {
+		t.Errorf("Expected a stack overflow with a 64 slot stack")
+	}
+
+	result = vm.interpret(nestedExpression(10))
+	if result != INTERPRET_OK {
+		t.Errorf("VM was unusable after a stack overflow")
+	}
+	vm.Free()
+}
+
+func TestInterpretResult(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	ctx := context.Background()
+
+	value, err := vm.Interpret(ctx, "var a = 20; a + 22;", "answer")
+	if err != nil || !value.IsNumber() || value.AsNumber() != 42 {
+		t.Errorf("Expected 42, got %v (%v)", value, err)
+	}
+
+	value, err = vm.Interpret(ctx, `"con" + "cat";`, "concat")
+	if err != nil || !value.IsString() || value.AsString() != "concat" {
+		t.Errorf("Expected \"concat\", got %v (%v)", value, err)
+	}
+
+	value, err = vm.Interpret(ctx, "1 < 2; { 3; } if (true) nil;", "last")
+	if err != nil || !value.IsNil() {
+		t.Errorf("Expected nil from the last statement executed, got %v (%v)", value, err)
+	}
+
+	// Blocks and unbraced bodies count alike; statements that don't run and
+	// statements inside functions don't count at all.
+	results := map[string]float64{
+		"1; { 2; }":                           2,
+		"1; if (true) 2;":                     2,
+		"1; if (false) 2;":                    1,
+		"1; { var a = 2; { a + 1; } }":        3,
+		"var i = 0; while (i < 3) i = i + 1;": 3,
+		"fun f() { 2; } 1; var x = f();":      1,
+	}
+	for source, want := range results {
+		value, err = vm.Interpret(ctx, source, "blocks")
+		if err != nil || value.AsNumber() != want {
+			t.Errorf("%s: expected %g, got %v (%v)", source, want, value, err)
+		}
+	}
+
+	value, err = vm.Interpret(ctx, "print 1;", "print")
+	if err != nil || !value.IsNil() {
+		t.Errorf("Expected nil without expression statements, got %v (%v)", value, err)
+	}
+
+	value, err = vm.Interpret(ctx, `"kept" + "alive";`, "rooted")
+	vm.collectGarbage()
+	if err != nil || value.AsString() != "keptalive" {
+		t.Errorf("Expected the result to survive a collection, got %v (%v)", value, err)
+	}
+
+	value, err = vm.Interpret(ctx, "fun f() { return true; } f();", "call")
+	if err != nil || !value.IsBool() || !value.AsBool() || value.String() != "true" {
+		t.Errorf("Expected true, got %v (%v)", value, err)
+	}
+	vm.Free()
+}
+
+func TestInterpretErrors(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+	ctx := context.Background()
+
+	_, err := vm.Interpret(ctx, "var = 1;\nprint ;", "broken.lox")
+	var compileError *CompileError
+	if !errors.As(err, &compileError) {
+		t.Fatalf("Expected a CompileError, got %v", err)
+	}
+	if compileError.Script != "broken.lox" || len(compileError.Diagnostics) != 2 {
+		t.Errorf("Unexpected compile error %+v", compileError)
+	}
+
+	_, err = vm.Interpret(ctx, "nil();", "call.lox")
+	var runtimeError *RuntimeError
+	if !errors.As(err, &runtimeError) {
+		t.Fatalf("Expected a RuntimeError, got %v", err)
+	}
+	if runtimeError.Script != "call.lox" || err.Error() != "Can only call functions and classes." {
+		t.Errorf("Unexpected runtime error %+v", runtimeError)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = vm.Interpret(canceled, "1;", "canceled")
+	if !errors.As(err, &runtimeError) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a *RuntimeError wrapping context.Canceled, got %v", err)
+	}
+	vm.Free()
+}
+
+// TestConcurrentVMs runs independent VMs side by side; run it with -race to
+// check that no compiler or allocator state is shared between them.
+func TestConcurrentVMs(t *testing.T) {
+	const workers = 16
+	source := `
+class Counter {
+	init(start) { this.count = start; }
+	next() { this.count = this.count + 1; return this.count; }
+}
+fun label(n) { return "item" + n; }
+var counter = Counter(%d);
+var text = "";
+for (var i = 0; i < 2000; i = i + 1) {
+	counter.next();
+	text = text + label("");
+}
+counter.count;
+`
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			vm := new(VM)
+			vm.Init()
+			defer vm.Free()
+
+			value, err := vm.Interpret(context.Background(), fmt.Sprintf(source, start), "worker")
+			if err != nil {
+				errs <- err
+			} else if value.AsNumber() != float64(start+2000) {
+				errs <- fmt.Errorf("worker %d finished with %v", start, value)
+			}
+		}(w * 1000)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDebugOutput(t *testing.T) {
+	var out strings.Builder
+	vm := new(VM)
+	vm.Options.Disassemble = true
+	vm.Options.TraceExecution = true
+	vm.Options.TraceGC = true
+	vm.Options.StressGC = true
+	vm.Options.DebugOutput = &out
+	vm.Init()
+	if result := vm.interpret(`var s = "a" + "b";`); result != INTERPRET_OK {
+		t.Fatalf("Interpret failed")
+	}
+	for _, want := range []string{"== <script> ==", "OP_ADD", "[nil a b]", "-- gc begin", "allocate"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Debug output is missing %q", want)
+		}
+	}
+	vm.Free()
+
+	out.Reset()
+	vm = new(VM)
+	vm.Options.DebugOutput = &out
+	vm.Init()
+	vm.interpret(`var s = "a" + "b";`)
+	if out.Len() != 0 {
+		t.Errorf("Expected no debug output by default, got:\n%s", out.String())
+	}
+	vm.Free()
+}
+
+func TestRedirectedStreams(t *testing.T) {
+	var stdout, stderr strings.Builder
+	vm := new(VM)
+	vm.Options.Stdout = &stdout
+	vm.Options.Stderr = &stderr
+	vm.Options.Stdin = strings.NewReader("print 1 + 2;\nprint \"two\";\nprint nil.x;\nprint ;\n")
+	vm.Init()
+	vm.Repl()
+
+	if want := "> 3\n> two\n> > > \n"; stdout.String() != want {
+		t.Errorf("Stdout = %q, want %q", stdout.String(), want)
+	}
+	for _, want := range []string{
+		"Only instances have properties.\n[line 1:10] in script\n",
+		"[line 1:7] Error at ';': Expect expression.\n    1 | print ;\n      |       ^\n",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("Stderr is missing %q:\n%s", want, stderr.String())
+		}
+	}
+	vm.Free()
+}
+
+func TestExecutionLimits(t *testing.T) {
+	ctx := context.Background()
+	limits := []struct {
+		name    string
+		options Options
+		source  string
+		cause   error
+	}{
+		{"instructions", Options{MaxInstructions: 10000}, "while (true) {}", ErrInstructionLimit},
+		{"heap", Options{MaxHeapBytes: 64 * 1024}, `var s = ""; while (true) s = s + "0123456789";`, ErrHeapLimit},
+		{"frames", Options{MaxFrames: 8}, "fun f(n) { return f(n + 1); } f(0);", ErrStackOverflow},
+		{"stack", Options{StackMax: 64}, nestedExpression(100), ErrStackOverflow},
+	}
+	for _, limit := range limits {
+		vm := new(VM)
+		vm.Options = limit.options
+		vm.Init()
+		_, err := vm.Interpret(ctx, limit.source, limit.name)
+		if !errors.Is(err, limit.cause) {
+			t.Errorf("%s: expected %v, got %v", limit.name, limit.cause, err)
+		}
+		var runtimeError *RuntimeError
+		if !errors.As(err, &runtimeError) {
+			t.Errorf("%s: expected a RuntimeError, got %T", limit.name, err)
+		}
+
+		if value, err := vm.Interpret(ctx, "1 + 1;", "after"); err != nil || value.AsNumber() != 2 {
+			t.Errorf("%s: VM was unusable after hitting the limit: %v", limit.name, err)
+		}
+		vm.Free()
+	}
+
+	vm := new(VM)
+	vm.Options.MaxHeapBytes = 64 * 1024
+	vm.Init()
+	// Garbage doesn't count against the heap limit.
+	source := `for (var i = 0; i < 10000; i = i + 1) { var s = "x" + "y"; s = s + s + s; }`
+	if _, err := vm.Interpret(ctx, source, "garbage"); err != nil {
+		t.Errorf("Expected collectable garbage to stay under the heap limit, got %v", err)
+	}
+	vm.Free()
+
+	vm = new(VM)
+	vm.Options.MaxFrames = 1000
+	vm.Init()
+	// The call stack grows past its initial FRAMES_MAX frames when allowed.
+	source = "fun depth(n) { if (n == 0) return 0; return depth(n - 1) + 1; } depth(900);"
+	if value, err := vm.Interpret(ctx, source, "deep"); err != nil || value.AsNumber() != 900 {
+		t.Errorf("Expected recursion 900 deep to succeed, got %v (%v)", value, err)
+	}
+	if _, err := vm.Interpret(ctx, "depth(1000);", "too deep"); !errors.Is(err, ErrStackOverflow) {
+		t.Errorf("Expected recursion past MaxFrames to overflow, got %v", err)
+	}
+	vm.Free()
+}
+
+func TestContextCancellation(t *testing.T) {
+	vm := new(VM)
+	vm.Init()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := vm.Interpret(ctx, "while (true) {}", "timeout")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to stop the script, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = vm.Interpret(ctx, "var i = 0; while (true) i = i + 1;", "cancel")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation to stop the script, got %v", err)
+	}
+	vm.Free()
 }
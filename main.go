@@ -1,22 +1,107 @@
 package main
 
 import (
-	"os"
+	"errors"
+	"flag"
+	"fmt"
 	"glox/glox"
+	"io/ioutil"
+	"os"
+	"strings"
 )
 
 func main() {
-	vm:=new(glox.VM)
+	if len(os.Args) > 1 && os.Args[1] == "compile" {
+		os.Exit(compile(os.Args[2:]))
+	}
+
+	vm := new(glox.VM)
+	flag.BoolVar(&vm.Options.Disassemble, "disassemble", false, "print the bytecode of each function after compiling it")
+	flag.BoolVar(&vm.Options.TraceExecution, "trace", false, "print the stack and each instruction as it executes")
+	flag.BoolVar(&vm.Options.TraceGC, "trace-gc", false, "log garbage collector activity")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: glox [flags] [path]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       glox compile path [-o output]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 	vm.Init()
 
-	if len(os.Args) == 1 {
+	if flag.NArg() == 0 {
 		vm.Repl()
-	} else if len(os.Args) == 2 {
-		vm.RunFile(os.Args[1])
+	} else if flag.NArg() == 1 {
+		if err := vm.RunFile(flag.Arg(0)); err != nil {
+			glox.ReportError(os.Stderr, err)
+			vm.Free()
+			os.Exit(exitCode(err))
+		}
 	} else {
-		os.Stderr.WriteString("Usage: glox [path]\n")
+		flag.Usage()
 		os.Exit(64)
 	}
 
 	vm.Free()
 }
+
+// compile implements "glox compile in.lox -o out.loxc", writing bytecode
+// that "glox out.loxc" runs without recompiling.
+func compile(args []string) int {
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	output := flags.String("o", "", "output `path` (default: the input with a .loxc extension)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: glox compile path [-o output]")
+		flags.PrintDefaults()
+	}
+
+	// Accept flags on either side of the input path.
+	var paths []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+		paths = append(paths, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(paths) != 1 {
+		flags.Usage()
+		return 64
+	}
+	input := paths[0]
+	if *output == "" {
+		*output = strings.TrimSuffix(input, ".lox") + ".loxc"
+	}
+
+	source, err := ioutil.ReadFile(input)
+	if err != nil {
+		glox.ReportError(os.Stderr, err)
+		return 74
+	}
+
+	vm := new(glox.VM)
+	vm.Init()
+	defer vm.Free()
+	data, err := vm.Compile(string(source), input)
+	if err == nil {
+		err = ioutil.WriteFile(*output, data, 0644)
+	}
+	if err != nil {
+		glox.ReportError(os.Stderr, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// exitCode follows the sysexits.h conventions used by clox.
+func exitCode(err error) int {
+	var compileError *glox.CompileError
+	var runtimeError *glox.RuntimeError
+	switch {
+	case errors.As(err, &compileError), errors.Is(err, glox.ErrInvalidBytecode):
+		return 65
+	case errors.As(err, &runtimeError):
+		return 70
+	default:
+		return 74
+	}
+}